@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+)
+
+// ashRequest averages the active sessions sampled every second by ASH over
+// the window, by wait class. Sessions on CPU have no wait class.
+const ashRequest = `SELECT NVL(wait_class, 'CPU') as wait_class, COUNT(*) / %d as average_active_sessions
+FROM v$active_session_history
+WHERE sample_time > SYSTIMESTAMP - NUMTODSINTERVAL(%d, 'SECOND')
+GROUP BY NVL(wait_class, 'CPU')`
+
+// ashMetric returns the metric of the ash collector over the last window
+// seconds. v$active_session_history is part of the Diagnostics Pack, the
+// collector is only scraped when its license is acknowledged.
+func ashMetric(window int) (*Metric, error) {
+	if window <= 0 {
+		return nil, fmt.Errorf("invalid ASH window: %d seconds", window)
+	}
+	return &Metric{
+		Context: "ash",
+		Labels:  []string{"wait_class"},
+		MetricsDesc: map[string]string{
+			"average_active_sessions": "Average number of active sessions by wait class over the ASH window from v$active_session_history.",
+		},
+		IgnoreZeroResult: true,
+		Request:          fmt.Sprintf(ashRequest, window, window),
+	}, nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+)
+
+// duration is a time.Duration decoded from a TOML string like "5m".
+type duration struct {
+	time.Duration
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (d *duration) UnmarshalText(text []byte) error {
+	var err error
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (d duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// cachedScrape holds the result of the last successful background scrape of
+// a metric.
+type cachedScrape struct {
+	metrics   []prometheus.Metric
+	timestamp time.Time
+}
+
+func cacheKey(env *dbEnvironment, metric *Metric) string {
+	return env.sid + "/" + metric.Context
+}
+
+// startBackgroundScrapes starts a goroutine per database and metric with a
+// background interval. Those metrics are scraped on their own schedule and
+// Collect serves the last result. The goroutines run until
+// e.stopBackground is closed.
+func (e *Exporter) startBackgroundScrapes() {
+	e.stopBackground = make(chan struct{})
+	for _, metric := range e.metricsToScrap {
+		if metric.BackgroundInterval.Duration <= 0 {
+			continue
+		}
+		if metric.PrimaryOnly && *databaseRole == "standby" {
+			continue
+		}
+		for _, env := range e.dbEnvs {
+			go e.scrapeInBackground(env, metric, e.stopBackground)
+		}
+	}
+}
+
+func (e *Exporter) scrapeInBackground(env *dbEnvironment, metric *Metric, stop <-chan struct{}) {
+	log.Infof("scraping metric: %s of SID: %s every %s", metric.Context, env.sid, metric.BackgroundInterval.Duration)
+	ticker := time.NewTicker(metric.BackgroundInterval.Duration)
+	defer ticker.Stop()
+	for {
+		e.backgroundScrape(env, metric, stop)
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (e *Exporter) backgroundScrape(env *dbEnvironment, metric *Metric, stop <-chan struct{}) {
+	var metrics []prometheus.Metric
+	var wg sync.WaitGroup
+	ch := make(chan prometheus.Metric)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for m := range ch {
+			metrics = append(metrics, m)
+		}
+	}()
+
+	log.Debugf("background scrape metric: %s", metric.Context)
+	err := env.resolveIdentity()
+	if err == nil {
+		err = ScrapeMetric(env, ch, metric)
+	}
+	close(ch)
+	wg.Wait()
+	e.countScrape(metric.Context, env.sid, err)
+	if isEmptyResult(err) {
+		// An empty result is cached like any other.
+		e.emptyResults.WithLabelValues(metric.Context, env.sid).Inc()
+		err = nil
+	}
+	if err != nil {
+		// Keep serving the previous result.
+		log.Errorln("error scraping for", metric.Context, ":", err)
+		e.scrapeErrors.WithLabelValues(metric.Context, env.sid).Inc()
+		return
+	}
+
+	e.cacheMtx.Lock()
+	defer e.cacheMtx.Unlock()
+	select {
+	case <-stop:
+		// The result belongs to a previous configuration.
+		return
+	default:
+	}
+	e.cache[cacheKey(env, metric)] = &cachedScrape{metrics: metrics, timestamp: time.Now()}
+}
+
+// collectCached sends the last background scrape result of metric. A result
+// older than the stale after duration of metric is no longer sent, so that
+// Prometheus marks its series stale instead of keeping a frozen value.
+func (e *Exporter) collectCached(env *dbEnvironment, metric *Metric, ch chan<- prometheus.Metric) {
+	e.cacheMtx.Lock()
+	cached, ok := e.cache[cacheKey(env, metric)]
+	e.cacheMtx.Unlock()
+	if !ok {
+		log.Debugf("no background scrape result yet for metric: %s", metric.Context)
+		return
+	}
+	age := time.Since(cached.timestamp)
+	e.cacheAge.WithLabelValues(metric.Context, env.sid).Set(age.Seconds())
+	if metric.StaleAfter.Duration > 0 && age > metric.StaleAfter.Duration {
+		log.Warnf("background scrape result of metric: %s of SID: %s is %s old, dropping it", metric.Context, env.sid, age.Round(time.Second))
+		return
+	}
+	for _, m := range cached.metrics {
+		ch <- m
+	}
+}
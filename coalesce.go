@@ -0,0 +1,97 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// scrapeLimiter bounds the number of concurrent collections of an exporter.
+// When coalescing, a scrape arriving while a collection is in progress waits
+// for it and is served its result instead of querying the databases again.
+type scrapeLimiter struct {
+	slots    chan struct{}
+	coalesce bool
+
+	mtx      sync.Mutex
+	inflight *sharedCollection
+}
+
+// sharedCollection is the result of a collection, complete once done is
+// closed.
+type sharedCollection struct {
+	done    chan struct{}
+	metrics []prometheus.Metric
+}
+
+func newScrapeLimiter(maxConcurrent int, coalesce bool) *scrapeLimiter {
+	l := &scrapeLimiter{coalesce: coalesce}
+	if maxConcurrent > 0 {
+		l.slots = make(chan struct{}, maxConcurrent)
+	}
+	return l
+}
+
+// collect collects exporter into ch within the limits of l.
+func (l *scrapeLimiter) collect(exporter *Exporter, ch chan<- prometheus.Metric, deadline time.Time) {
+	if !l.coalesce {
+		l.acquire()
+		defer l.release()
+		exporter.collect(ch, deadline)
+		return
+	}
+
+	l.mtx.Lock()
+	shared := l.inflight
+	first := shared == nil
+	if first {
+		shared = &sharedCollection{done: make(chan struct{})}
+		l.inflight = shared
+	}
+	l.mtx.Unlock()
+
+	if first {
+		l.acquire()
+		shared.metrics = gatherMetrics(exporter, deadline)
+		l.release()
+		l.mtx.Lock()
+		l.inflight = nil
+		l.mtx.Unlock()
+		close(shared.done)
+	} else {
+		<-shared.done
+	}
+	for _, m := range shared.metrics {
+		ch <- m
+	}
+}
+
+func (l *scrapeLimiter) acquire() {
+	if l.slots != nil {
+		l.slots <- struct{}{}
+	}
+}
+
+func (l *scrapeLimiter) release() {
+	if l.slots != nil {
+		<-l.slots
+	}
+}
+
+// gatherMetrics returns the metrics collected from exporter.
+func gatherMetrics(exporter *Exporter, deadline time.Time) []prometheus.Metric {
+	var metrics []prometheus.Metric
+	ch := make(chan prometheus.Metric)
+	done := make(chan struct{})
+	go func() {
+		for m := range ch {
+			metrics = append(metrics, m)
+		}
+		close(done)
+	}()
+	exporter.collect(ch, deadline)
+	close(ch)
+	<-done
+	return metrics
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/cyberark/conjur-api-go/conjurapi"
+	"github.com/prometheus/common/log"
+)
+
+// conjurReader returns a secretReader of the Conjur variables under the
+// conjur.prefix. The Conjur client is configured and authenticated from the
+// standard Conjur files and environment variables, like the host identity.
+func conjurReader() (secretReader, error) {
+	config, err := conjurapi.LoadConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the conjur configuration with: %s", err)
+	}
+	client, err := conjurapi.NewClientFromEnvironment(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the conjur client with: %s", err)
+	}
+	return func(keyname *string) (string, error) {
+		id := fmt.Sprintf("%s/%s", *conjurPrefix, *keyname)
+		value, err := client.RetrieveSecret(id)
+		if err != nil {
+			return "", fmt.Errorf("failed to retrieve conjur variable: %s with: %s", id, err)
+		}
+		return string(value), nil
+	}, nil
+}
+
+// generateConjurDSN builds the database environments from the connection
+// settings stored in Conjur.
+func generateConjurDSN() ([]*dbEnvironment, error) {
+	if *conjurPrefix == "" {
+		return nil, errors.New("no data source configured, set either --dsn or --conjur.prefix")
+	}
+	read, err := conjurReader()
+	if err != nil {
+		return nil, err
+	}
+	sids, err := read(ssmSIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	var dbEnvs []*dbEnvironment
+	for _, sid := range strings.Split(sids, ",") {
+		if sid = strings.TrimSpace(sid); sid == "" {
+			continue
+		}
+		credentials := secretCredentials(read, sid)
+		dsn, err := credentials()
+		if err != nil {
+			return nil, err
+		}
+		log.Infof("found oracle SID: %s in conjur", sid)
+		dbEnvs = append(dbEnvs, &dbEnvironment{sid: sid, dsn: dsn, credentials: credentials})
+	}
+	if len(dbEnvs) == 0 {
+		return nil, fmt.Errorf("no sid defined in conjur variable: %s/%s", *conjurPrefix, *ssmSIDs)
+	}
+	return dbEnvs, nil
+}
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	oci8 "github.com/mattn/go-oci8"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+)
+
+// connectDuration tracks the time needed to log in to the database.
+var connectDuration = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Subsystem: exporter,
+	Name:      "connect_duration_seconds",
+	Help:      "Duration of the last connection establishment to Oracle DB.",
+}, []string{"sid"})
+
+// sessionConnector opens oci8 connections and prepares their session before
+// they are handed to the pool.
+type sessionConnector struct {
+	sid        string
+	dsn        string
+	statements []string
+}
+
+// Connect implements driver.Connector.
+func (c *sessionConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	start := time.Now()
+	conn, err := oci8.OCI8Driver.Open(c.dsn)
+	if err != nil {
+		return nil, err
+	}
+	connectDuration.WithLabelValues(c.sid).Set(time.Since(start).Seconds())
+	for _, statement := range c.statements {
+		if err := execStatement(conn, statement); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// Driver implements driver.Connector.
+func (c *sessionConnector) Driver() driver.Driver {
+	return oci8.OCI8Driver
+}
+
+func execStatement(conn driver.Conn, statement string) error {
+	stmt, err := conn.Prepare(statement)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.Exec(nil)
+	return err
+}
+
+// schemaName matches an unquoted Oracle identifier, the current schema is
+// concatenated to the ALTER SESSION statement.
+var schemaName = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_$#]*$`)
+
+// checkSessionSettings returns an error if the settings of the sessions can't
+// be used in their statements.
+func checkSessionSettings() error {
+	if *currentSchema != "" && !schemaName.MatchString(*currentSchema) {
+		return fmt.Errorf("invalid current schema: %s, it must be an unquoted identifier", *currentSchema)
+	}
+	return nil
+}
+
+// sessionStatements returns the statements run on every new connection.
+func sessionStatements() []string {
+	var statements []string
+	if *currentSchema != "" {
+		statements = append(statements, "ALTER SESSION SET CURRENT_SCHEMA = "+*currentSchema)
+	}
+	if *consumerGroup != "" {
+		// Fail the connection rather than run unthrottled queries when the
+		// switch isn't granted.
+		statements = append(statements, fmt.Sprintf(
+			"DECLARE old_group VARCHAR2(128); BEGIN DBMS_SESSION.SWITCH_CURRENT_CONSUMER_GROUP('%s', old_group, FALSE); END;",
+			strings.Replace(*consumerGroup, "'", "''", -1)))
+	}
+	return statements
+}
+
+// openDB returns the connection pool of the database behind dsn.
+func openDB(sid string, dsn string) (*sql.DB, error) {
+	return sql.OpenDB(&sessionConnector{sid: sid, dsn: withNetTimeouts(dsn), statements: sessionStatements()}), nil
+}
+
+// withNetTimeouts rewrites the easy connect string of dsn
+// (user/password@host:port/service) to a connect descriptor carrying the
+// Oracle Net connect timeouts, so that an unreachable host fails fast. Other
+// connect strings, like TNS aliases, are returned unchanged.
+func withNetTimeouts(dsn string) string {
+	if *connectTimeout <= 0 && *transportTimeout <= 0 {
+		return dsn
+	}
+	at := strings.LastIndex(dsn, "@")
+	if at < 0 {
+		return dsn
+	}
+	credentials, connect := dsn[:at+1], dsn[at+1:]
+	var params string
+	if i := strings.Index(connect, "?"); i >= 0 {
+		connect, params = connect[:i], connect[i:]
+	}
+	slash := strings.Index(connect, "/")
+	if slash < 0 || strings.HasPrefix(connect, "(") {
+		return dsn
+	}
+	address, service := connect[:slash], connect[slash+1:]
+	host, port := address, "1521"
+	if i := strings.LastIndex(address, ":"); i >= 0 && i > strings.LastIndex(address, "]") {
+		host, port = address[:i], address[i+1:]
+	}
+	host = strings.Trim(host, "[]")
+
+	var timeouts string
+	if *connectTimeout > 0 {
+		timeouts += fmt.Sprintf("(CONNECT_TIMEOUT=%d)", *connectTimeout)
+	}
+	if *transportTimeout > 0 {
+		timeouts += fmt.Sprintf("(TRANSPORT_CONNECT_TIMEOUT=%d)", *transportTimeout)
+	}
+	descriptor := fmt.Sprintf("(DESCRIPTION=%s(ADDRESS=(PROTOCOL=TCP)(HOST=%s)(PORT=%s))(CONNECT_DATA=(SERVICE_NAME=%s)))",
+		timeouts, host, port, service)
+	return credentials + descriptor + params
+}
+
+// pools are the connection pools of a database opened with the same DSN.
+type pools struct {
+	dsn         string
+	db          *sql.DB
+	dedicatedDB *sql.DB
+	// users counts the callers querying the pools, they are closed once
+	// they were replaced and all their users released them.
+	users sync.WaitGroup
+}
+
+// connections holds the current pools of a database. It is shared by the
+// copies of its environment, the pools are replaced when the database is
+// reopened while other goroutines query it.
+type connections struct {
+	mtx   sync.Mutex
+	pools *pools
+	// authFailed is the time of the last failed login, the database isn't
+	// logged in to for -database.auth-backoff afterwards.
+	authFailed time.Time
+}
+
+// openPools opens the connection pools of the database of sid behind dsn.
+func openPools(sid string, dsn string) (*pools, error) {
+	db, err := openDB(sid, dsn)
+	if err != nil {
+		return nil, err
+	}
+	configurePool(db, 1)
+	// Connections are only opened once a dedicated metric is scraped.
+	dedicatedDB, err := openDB(sid, dsn)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	configurePool(dedicatedDB, *dedicatedPoolSize)
+	return &pools{dsn: dsn, db: db, dedicatedDB: dedicatedDB}, nil
+}
+
+// close closes the pools of the database of sid once their users released
+// them.
+func (p *pools) close(sid string) {
+	p.users.Wait()
+	for _, db := range []*sql.DB{p.db, p.dedicatedDB} {
+		if err := db.Close(); err != nil {
+			log.Errorf("failed to close the connections of SID: %s with: %s", sid, err)
+		}
+	}
+}
+
+// database returns the connection pool env queries, the dedicated pool for
+// the metrics with dedicated set, along with the function releasing it once
+// the caller is done with it.
+func (env *dbEnvironment) database() (*sql.DB, func()) {
+	env.conns.mtx.Lock()
+	p := env.conns.pools
+	p.users.Add(1)
+	env.conns.mtx.Unlock()
+	if env.dedicated {
+		return p.dedicatedDB, p.users.Done
+	}
+	return p.db, p.users.Done
+}
+
+// currentDSN returns the DSN the database of env is connected with, which
+// changes when its credentials are rotated.
+func (env *dbEnvironment) currentDSN() string {
+	if env.conns == nil {
+		return env.dsn
+	}
+	env.conns.mtx.Lock()
+	defer env.conns.mtx.Unlock()
+	return env.conns.pools.dsn
+}
+
+// reopen replaces the connection pools of env by pools connected with dsn.
+// The previous pools are closed once the queries using them completed.
+func (env *dbEnvironment) reopen(dsn string) error {
+	p, err := openPools(env.sid, dsn)
+	if err != nil {
+		return err
+	}
+	env.conns.mtx.Lock()
+	old := env.conns.pools
+	env.conns.pools = p
+	env.conns.authFailed = time.Time{}
+	env.conns.mtx.Unlock()
+	env.forgetIdentity()
+	go old.close(env.sid)
+	return nil
+}
+
+// setAuthFailed starts the backoff of env after a failed login.
+func (env *dbEnvironment) setAuthFailed() {
+	env.conns.mtx.Lock()
+	env.conns.authFailed = time.Now()
+	env.conns.mtx.Unlock()
+}
+
+// clearAuthBackoff ends the backoff of env, the next scrape logs in again.
+func (env *dbEnvironment) clearAuthBackoff() {
+	env.conns.mtx.Lock()
+	env.conns.authFailed = time.Time{}
+	env.conns.mtx.Unlock()
+}
+
+// inAuthBackoff reports whether env isn't logged in to since its last login
+// failed.
+func (env *dbEnvironment) inAuthBackoff() bool {
+	env.conns.mtx.Lock()
+	defer env.conns.mtx.Unlock()
+	return !env.conns.authFailed.IsZero() && time.Since(env.conns.authFailed) < time.Duration(*authBackoff)*time.Second
+}
+
+// openDatabases opens the connection pools of dbEnvs and starts their
+// keepalive.
+func openDatabases(dbEnvs []*dbEnvironment) {
+	for _, env := range dbEnvs {
+		env.done = make(chan struct{})
+		env.identity = new(identity)
+		p, err := openPools(env.sid, env.dsn)
+		if err != nil {
+			log.Fatalf("unable to connect to: %s, failed with: %s", env.dsn, err)
+		}
+		env.conns = &connections{pools: p}
+		if *keepaliveInterval > 0 {
+			go keepalive(env, time.Duration(*keepaliveInterval)*time.Second)
+		}
+		if *haLockName != "" {
+			go elect(env, time.Duration(*haLockInterval)*time.Second)
+		}
+	}
+}
+
+// warmup connects to the databases of dbEnvs, concurrency at a time, so that
+// the first scrapes find open connections. It returns after timeout at the
+// latest. The databases that couldn't be connected are scraped like the others
+// and reported down while they can't be reached.
+func warmup(dbEnvs []*dbEnvironment, concurrency int, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	start := time.Now()
+	var connected int32
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, concurrency)
+	for _, env := range dbEnvs {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func(env *dbEnvironment) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			db, release := env.database()
+			defer release()
+			if err := db.PingContext(ctx); err != nil {
+				log.Warnf("failed to connect to SID: %s at startup with: %s", env.sid, err)
+				return
+			}
+			atomic.AddInt32(&connected, 1)
+		}(env)
+	}
+	// A connection attempt may not return at the deadline, don't wait for it.
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+	log.Infof("connected to %d of %d SIDs at startup in %s", atomic.LoadInt32(&connected), len(dbEnvs), time.Since(start).Round(time.Millisecond))
+}
+
+// closeDatabases stops the keepalive and leader election of dbEnvs and
+// closes their connection pools once they are no longer used.
+func closeDatabases(dbEnvs []*dbEnvironment) {
+	for _, env := range dbEnvs {
+		log.Infof("closing the connections of SID: %s", env.sid)
+		close(env.done)
+		env.conns.mtx.Lock()
+		p := env.conns.pools
+		env.conns.mtx.Unlock()
+		p.close(env.sid)
+		connectDuration.DeleteLabelValues(env.sid)
+	}
+}
+
+// configurePool sets the connection pool limits of db.
+func configurePool(db *sql.DB, maxConns int) {
+	// By design exporter should use maximum one connection per request.
+	db.SetMaxOpenConns(maxConns)
+	db.SetMaxIdleConns(maxConns)
+	// Set max lifetime for a connection.
+	db.SetConnMaxLifetime(time.Duration(*connMaxLifetime) * time.Second)
+}
+
+// keepalive pings the database of env at every interval so that its idle
+// connection isn't dropped between scrapes. It returns once env is closed.
+func keepalive(env *dbEnvironment, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-env.done:
+			return
+		}
+		if env.inAuthBackoff() {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		db, release := env.database()
+		if err := db.PingContext(ctx); err != nil {
+			log.Debugf("keepalive ping failed for SID: %s with: %s", env.sid, err)
+		}
+		release()
+		cancel()
+	}
+}
+
+// validateConnection runs the validation query on the database of env, so
+// that the database is only up when a session can run queries.
+func validateConnection(env *dbEnvironment) error {
+	db, release := env.database()
+	defer release()
+	if *validationQuery == "" {
+		return db.Ping()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), env.timeout())
+	defer cancel()
+	rows, err := db.QueryContext(ctx, *validationQuery)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+	}
+	return rows.Err()
+}
+
+// redactDSN replaces the password of dsn so that it can be printed.
+func redactDSN(dsn string) string {
+	at := strings.LastIndex(dsn, "@")
+	if at < 0 {
+		return dsn
+	}
+	slash := strings.Index(dsn[:at], "/")
+	if slash < 0 {
+		return dsn
+	}
+	return dsn[:slash+1] + "***" + dsn[at:]
+}
+
+// testConnections connects to every database, runs a trivial query and
+// prints the outcome. It returns false if any of the databases failed.
+func testConnections(dbEnvs []*dbEnvironment) bool {
+	ok := true
+	for _, env := range dbEnvs {
+		if err := checkConnection(env); err != nil {
+			fmt.Printf("FAIL %s (%s): %s\n", env.sid, redactDSN(env.dsn), err)
+			ok = false
+			continue
+		}
+		fmt.Printf("OK   %s (%s)\n", env.sid, redactDSN(env.dsn))
+	}
+	return ok
+}
+
+func checkConnection(env *dbEnvironment) error {
+	db, err := openDB(env.sid, env.dsn)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), env.timeout())
+	defer cancel()
+	var one int
+	return db.QueryRowContext(ctx, "SELECT 1 FROM dual").Scan(&one)
+}
+
+// refreshCredentials fetches the credentials of env again and reopens its
+// database with them if they changed. It is used after a failed login, when
+// the password may have been rotated.
+func refreshCredentials(env *dbEnvironment) error {
+	dsn, err := env.credentials()
+	if err != nil {
+		return err
+	}
+	if dsn == env.currentDSN() {
+		log.Debugf("credentials of SID: %s are unchanged", env.sid)
+		return nil
+	}
+	log.Infof("credentials of SID: %s changed, reconnecting", env.sid)
+	return env.reopen(dsn)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// scrapeTimeoutHeader is the header Prometheus sends its scrape timeout in.
+const scrapeTimeoutHeader = "X-Prometheus-Scrape-Timeout-Seconds"
+
+// requestCollector collects exporter for a single scrape request, knowing the
+// time the request times out at. Describe sends nothing, so that registering
+// it unchecked doesn't scrape the databases.
+type requestCollector struct {
+	exporter *Exporter
+	limiter  *scrapeLimiter
+	deadline time.Time
+}
+
+// Describe implements prometheus.Collector.
+func (c requestCollector) Describe(ch chan<- *prometheus.Desc) {}
+
+// Collect implements prometheus.Collector.
+func (c requestCollector) Collect(ch chan<- prometheus.Metric) {
+	c.limiter.collect(c.exporter, ch, c.deadline)
+}
+
+// metricsHandler serves the metrics of exporter, collected with the deadline
+// of each request within the concurrency limits, along with the metrics of
+// gatherers.
+func metricsHandler(exporter *Exporter, gatherers ...prometheus.Gatherer) http.Handler {
+	limiter := newScrapeLimiter(*maxScrapes, *coalesceScrapes)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(requestCollector{exporter: exporter, limiter: limiter, deadline: requestDeadline(r)})
+		all := append(prometheus.Gatherers{registry}, gatherers...)
+		promhttp.HandlerFor(all, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+	})
+}
+
+// requestDeadline returns the time the scrape request r times out at, from
+// the Prometheus scrape timeout or the deadline of the request context. It is
+// zero when unknown.
+func requestDeadline(r *http.Request) time.Time {
+	if timeout, err := strconv.ParseFloat(r.Header.Get(scrapeTimeoutHeader), 64); err == nil && timeout > 0 {
+		return time.Now().Add(time.Duration(timeout * float64(time.Second)))
+	}
+	deadline, _ := r.Context().Deadline()
+	return deadline
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+)
+
+// labelChanges counts the scrapes that exported a metric with other label
+// names than the first time.
+var labelChanges = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Subsystem: exporter,
+	Name:      "label_changes_total",
+	Help:      "Total number of times the metric was exported with other label names than the first time.",
+}, []string{"metric"})
+
+// descCache hands out the descriptors of the scraped metrics. A metric name
+// keeps the label names it was first seen with, so that a query can't change
+// its label cardinality between scrapes. The check is set by
+// -metric.label-check.
+type descCache struct {
+	mtx    sync.Mutex
+	labels map[string][]string
+	descs  map[string]*prometheus.Desc
+}
+
+var descs = &descCache{
+	labels: make(map[string][]string),
+	descs:  make(map[string]*prometheus.Desc),
+}
+
+// newDesc returns the descriptor of the metric fqName with the given labels,
+// or an error if the labels are invalid or fqName was already used with other
+// label names and the label check is strict.
+func newDesc(fqName string, help string, variableLabels []string, constLabels prometheus.Labels) (*prometheus.Desc, error) {
+	if err := checkLabelNames(variableLabels, constLabels); err != nil {
+		return nil, fmt.Errorf("metric: %s %s", fqName, err)
+	}
+	return descs.get(fqName, help, variableLabels, constLabels)
+}
+
+// checkLabelNames returns an error if a label name is invalid or used twice,
+// which would make prometheus.NewDesc return a descriptor that can't be
+// collected.
+func checkLabelNames(variableLabels []string, constLabels prometheus.Labels) error {
+	seen := make(map[string]bool)
+	for name := range constLabels {
+		seen[name] = true
+	}
+	for _, name := range variableLabels {
+		if seen[name] {
+			return fmt.Errorf("has the label: %s twice", name)
+		}
+		seen[name] = true
+	}
+	for name := range seen {
+		if !model.LabelName(name).IsValid() {
+			return fmt.Errorf("has the invalid label name: %s", name)
+		}
+	}
+	return nil
+}
+
+func (c *descCache) get(fqName string, help string, variableLabels []string, constLabels prometheus.Labels) (*prometheus.Desc, error) {
+	labelNames := make([]string, 0, len(variableLabels)+len(constLabels))
+	labelNames = append(labelNames, variableLabels...)
+	constPairs := make([]string, 0, len(constLabels))
+	for name, value := range constLabels {
+		labelNames = append(labelNames, name)
+		constPairs = append(constPairs, name+"="+value)
+	}
+	sort.Strings(constPairs)
+	// The variable labels are in the order of the label values, a metric
+	// exported with other label names gets its own descriptor.
+	key := fqName + "{" + strings.Join(constPairs, ",") + "}" + strings.Join(variableLabels, ",")
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if known, ok := c.labels[fqName]; ok {
+		if *labelCheck != "off" && !sameLabels(known, labelNames) {
+			labelChanges.WithLabelValues(fqName).Inc()
+			if *labelCheck == "strict" {
+				return nil, fmt.Errorf("metric: %s changed its labels from %v to %v", fqName, known, labelNames)
+			}
+			log.Warnf("metric: %s changed its labels from %v to %v", fqName, known, labelNames)
+		}
+	} else {
+		c.labels[fqName] = labelNames
+	}
+	if desc, ok := c.descs[key]; ok {
+		return desc, nil
+	}
+	desc := prometheus.NewDesc(fqName, help, variableLabels, constLabels)
+	c.descs[key] = desc
+	return desc, nil
+}
+
+// reset forgets the label names of all metrics.
+func (c *descCache) reset() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.labels = make(map[string][]string)
+	c.descs = make(map[string]*prometheus.Desc)
+}
+
+// sameLabels reports whether a and b hold the same label names in any order.
+func sameLabels(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	count := make(map[string]int)
+	for _, name := range a {
+		count[name]++
+	}
+	for _, name := range b {
+		if count[name] == 0 {
+			return false
+		}
+		count[name]--
+	}
+	return true
+}
@@ -6,11 +6,16 @@ require (
 	github.com/BurntSushi/toml v0.3.1
 	github.com/alecthomas/units v0.0.0-20190924025748-f65c72e2690d // indirect
 	github.com/aws/aws-sdk-go v1.28.7
+	github.com/cyberark/conjur-api-go v0.5.2
+	github.com/go-kit/kit v0.10.0
 	github.com/konsorten/go-windows-terminal-sequences v1.0.2 // indirect
 	github.com/mattn/go-oci8 v0.0.2
 	github.com/mitchellh/go-ps v0.0.0-20190716172923-621e5597135b
-	github.com/prometheus/client_golang v1.3.0
-	github.com/prometheus/common v0.9.1
+	github.com/prometheus/client_golang v1.7.1
+	github.com/prometheus/client_model v0.2.0
+	github.com/prometheus/common v0.15.0
+	github.com/prometheus/exporter-toolkit v0.5.1
+	go.uber.org/automaxprocs v1.3.0
 	golang.org/x/sys v0.0.0-20200122134326-e047566fdf82 // indirect
 	gopkg.in/alecthomas/kingpin.v2 v2.2.6
 )
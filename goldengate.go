@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// heartbeatTableName matches a, possibly schema qualified, table or view name.
+var heartbeatTableName = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_$#]*(\.[A-Za-z][A-Za-z0-9_$#]*)?$`)
+
+// goldenGateRequest reads the replication lag from a GoldenGate heartbeat
+// table or view, like GG_LAG or GG_HEARTBEAT. The incoming lag is measured
+// from the remote database and the outgoing lag towards it.
+const goldenGateRequest = `SELECT source, target, MAX(lag) as lag_seconds FROM (
+  SELECT remote_database as source, local_database as target, incoming_lag as lag FROM %[1]s WHERE incoming_lag IS NOT NULL
+  UNION ALL
+  SELECT local_database as source, remote_database as target, outgoing_lag as lag FROM %[1]s WHERE outgoing_lag IS NOT NULL
+)
+GROUP BY source, target`
+
+// goldenGateMetric returns the metric of the goldengate collector reading
+// the heartbeat table.
+func goldenGateMetric(table string) (*Metric, error) {
+	if !heartbeatTableName.MatchString(table) {
+		return nil, fmt.Errorf("invalid GoldenGate heartbeat table: %s", table)
+	}
+	return &Metric{
+		Context: "goldengate",
+		Labels:  []string{"source", "target"},
+		MetricsDesc: map[string]string{
+			"lag_seconds": "Replication lag in seconds from the source to the target database from the GoldenGate heartbeat table.",
+		},
+		IgnoreZeroResult: true,
+		Request:          fmt.Sprintf(goldenGateRequest, table),
+	}, nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// identity caches the sid label a database reports with the identity query.
+// The pool may reconnect to another instance of a service, so the label
+// expires with the connections.
+type identity struct {
+	mtx      sync.Mutex
+	label    string
+	resolved time.Time
+}
+
+// sidLabel returns the value of the sid label of the metrics scraped from env:
+// the result of the identity query once resolved, the configured SID
+// otherwise.
+func (env *dbEnvironment) sidLabel() string {
+	if env.identity == nil {
+		return env.sid
+	}
+	env.identity.mtx.Lock()
+	defer env.identity.mtx.Unlock()
+	if env.identity.label == "" {
+		return env.sid
+	}
+	return env.identity.label
+}
+
+// resolveIdentity runs the identity query on the database of env unless its
+// last result is younger than the connections.
+func (env *dbEnvironment) resolveIdentity() error {
+	if *identityQuery == "" || *disableSIDLabel || env.identity == nil {
+		return nil
+	}
+	env.identity.mtx.Lock()
+	defer env.identity.mtx.Unlock()
+	if env.identity.label != "" && time.Since(env.identity.resolved) < time.Duration(*connMaxLifetime)*time.Second {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), env.timeout())
+	defer cancel()
+	var label sql.NullString
+	db, release := env.database()
+	defer release()
+	if err := db.QueryRowContext(ctx, *identityQuery).Scan(&label); err != nil {
+		return err
+	}
+	if strings.TrimSpace(label.String) == "" {
+		return errors.New("the identity query returned an empty value")
+	}
+	env.identity.label = strings.TrimSpace(label.String)
+	env.identity.resolved = time.Now()
+	return nil
+}
+
+// forgetIdentity drops the cached identity of env, after its database was
+// reopened.
+func (env *dbEnvironment) forgetIdentity() {
+	if env.identity == nil {
+		return
+	}
+	env.identity.mtx.Lock()
+	env.identity.label = ""
+	env.identity.mtx.Unlock()
+}
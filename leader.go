@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"hash/fnv"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+)
+
+// leader tracks whether this exporter instance holds the scrape lock of
+// each SID.
+var leader = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Subsystem: exporter,
+	Name:      "leader",
+	Help:      "Whether this exporter instance holds the scrape lock of the database (1 for leader, 0 for standby).",
+}, []string{"sid"})
+
+// Exclusive mode and results of DBMS_LOCK.REQUEST. The package constants
+// can't be referenced from SQL.
+const (
+	lockExclusive   = 6
+	lockGranted     = 0
+	lockAlreadyOwns = 4
+)
+
+// lockID maps the lock name to the range of the user locks of DBMS_LOCK.
+func lockID(name string) int64 {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return int64(h.Sum32() % 1073741824)
+}
+
+// isLeader reports whether the exporter may scrape the metrics of env. It is
+// always true without leader election.
+func (env *dbEnvironment) isLeader() bool {
+	return *haLockName == "" || atomic.LoadInt32(&env.leader) == 1
+}
+
+// elect tries to take the scrape lock of env at every interval and keeps it
+// on a dedicated session. The lock is held until the session ends, so another
+// instance takes over when the leader stops. It returns once env is closed.
+func elect(env *dbEnvironment, interval time.Duration) {
+	id := lockID(*haLockName)
+	var db *sql.DB
+	var conn *sql.Conn
+	release := func() {
+		if conn != nil {
+			conn.Close()
+			conn = nil
+		}
+		if db != nil {
+			db.Close()
+			db = nil
+		}
+		atomic.StoreInt32(&env.leader, 0)
+		leader.WithLabelValues(env.sid).Set(0)
+	}
+	release()
+
+	request := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		if conn == nil {
+			// Don't log in while the database is in its login backoff.
+			if env.inAuthBackoff() {
+				cancel()
+				return
+			}
+			var err error
+			if db, err = openDB(env.sid, env.currentDSN()); err == nil {
+				db.SetMaxOpenConns(1)
+				conn, err = db.Conn(ctx)
+			}
+			if err != nil {
+				log.Debugf("failed to open the lock session of SID: %s with: %s", env.sid, err)
+				cancel()
+				release()
+				return
+			}
+		}
+		var result int
+		err := conn.QueryRowContext(ctx, "SELECT DBMS_LOCK.REQUEST(id => :1, lockmode => :2, timeout => 0) FROM dual", id, lockExclusive).Scan(&result)
+		cancel()
+		switch {
+		case err != nil:
+			log.Errorf("failed to request the scrape lock of SID: %s with: %s", env.sid, err)
+			release()
+		case result == lockGranted || result == lockAlreadyOwns:
+			if atomic.SwapInt32(&env.leader, 1) == 0 {
+				log.Infof("became the leader of SID: %s", env.sid)
+			}
+			leader.WithLabelValues(env.sid).Set(1)
+		default:
+			if atomic.SwapInt32(&env.leader, 0) == 1 {
+				log.Infof("lost the leadership of SID: %s", env.sid)
+			}
+			leader.WithLabelValues(env.sid).Set(0)
+		}
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		request()
+		select {
+		case <-ticker.C:
+		case <-env.done:
+			release()
+			leader.DeleteLabelValues(env.sid)
+			return
+		}
+	}
+}
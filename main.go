@@ -2,11 +2,23 @@ package main
 
 import (
 	"context"
+	"crypto/sha1"
 	"database/sql"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"math"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -16,11 +28,16 @@ import (
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ssm"
-
-	_ "github.com/mattn/go-oci8"
+	kitlog "github.com/go-kit/kit/log"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/push"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
 	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/exporter-toolkit/web"
+	"go.uber.org/automaxprocs/maxprocs"
 	"gopkg.in/alecthomas/kingpin.v2"
 )
 
@@ -29,23 +46,87 @@ var (
 	Version            = "0.0.0.dev"
 	app                = kingpin.New("oracle exporter", "A oracle metrics exporter")
 	listenAddress      = app.Flag("web.listen-address", "Address to listen on for web interface and telemetry.").Default(":9161").String()
+	webNetwork         = app.Flag("web.network", "Network of the web interface listener (tcp, tcp4 or tcp6).").Default("tcp").Enum("tcp", "tcp4", "tcp6")
+	webConfig          = app.Flag("web.config.file", "Path to a Prometheus web configuration file that can enable TLS or authentication.").Default("").String()
 	metricPath         = app.Flag("web.telemetry-path", "Path under which to expose metrics.").Default("/metrics").String()
+	extraMetricPaths   = app.Flag("web.extra-metrics-path", "Additional path serving only the given comma separated metric contexts, which are no longer served on the telemetry path (path=context,...). Can be repeated.").StringMap()
+	maxHeaderBytes     = app.Flag("web.max-header-bytes", "Maximum size of the request headers (in bytes).").Default("1048576").Int()
+	maxConnections     = app.Flag("web.max-connections", "Maximum number of simultaneous connections (0 for no limit).").Default("0").Int()
+	maxScrapes         = app.Flag("web.max-concurrent-scrapes", "Maximum number of scrapes of a metrics path collecting at the same time, the others wait (0 for no limit).").Default("0").Int()
+	coalesceScrapes    = app.Flag("web.coalesce-scrapes", "Serve the scrapes arriving during a collection with its result instead of collecting again.").Default("false").Bool()
+	configEndpoint     = app.Flag("web.enable-config", "Serve the definitions of the scraped metrics of every metrics path as JSON on /config.").Default("false").Bool()
+	strictMode         = app.Flag("web.strict", "Answer scrapes with HTTP 500 when none of the databases could be scraped.").Default("false").Bool()
 	landingPage        = []byte("<html><head><title>Oracle DB Exporter " + Version + "</title></head><body><h1>Oracle DB Exporter " + Version + "</h1><p><a href='" + *metricPath + "'>Metrics</a></p></body></html>")
 	defaultFileMetrics = app.Flag("default.metrics", "File with default metrics in a TOML file.").Default("default-metrics.toml").String()
-	customMetrics      = app.Flag("custom.metrics", "File that may contain various custom metrics in a TOML file.").Envar("CUSTOM_METRICS").String()
+	customMetrics      = app.Flag("custom.metrics", "Comma separated list of TOML files that may contain various custom metrics. A file can be an http(s):// or s3://bucket/key URL.").Envar("CUSTOM_METRICS").String()
+	customFetchTimeout = app.Flag("custom.metrics-fetch-timeout", "Timeout to fetch a custom metrics file from a URL (in seconds).").Default("10").Int()
+	reloadDefaults     = app.Flag("reload.default-metrics", "Read the default metrics file again on SIGHUP, not only the custom metrics files.").Default("false").Bool()
+	overrideMetrics    = app.Flag("custom.metrics-override", "Custom metrics replace the default metrics of the same context instead of being scraped along them.").Default("false").Bool()
+	enableCollectors   = app.Flag("collector.enable", "Comma separated list of metric contexts to scrape even if they are disabled by default.").Default("").String()
+	disableCollectors  = app.Flag("collector.disable", "Comma separated list of metric contexts not to scrape.").Default("").String()
+	diagnosticsPack    = app.Flag("license.diagnostics-pack", "Acknowledge that the databases are licensed for the Oracle Diagnostics Pack, which enables the ash collector.").Default("false").Bool()
+	ashWindow          = app.Flag("collector.ash.window", "Window the ash collector averages the active sessions over (in seconds).").Default("60").Int()
+	heartbeatTable     = app.Flag("collector.goldengate.heartbeat-table", "GoldenGate heartbeat table or view the goldengate collector reads the replication lag from, like ggadmin.gg_lag (empty to disable it).").Default("").String()
+	labelCheck         = app.Flag("metric.label-check", "What happens when a metric is exported with other label names than the first time: strict fails its scrape, warn logs it and exports the metric, off exports it silently.").Default("strict").Enum("strict", "warn", "off")
+	metricRenames      = app.Flag("metric.rename", "Rename a metric context at load time (old=new). Can be repeated.").StringMap()
+
+	targetConfigFile = app.Flag("target.config-file", "TOML file with settings overriding the flags per SID.").Default("").String()
+	testConnection   = app.Flag("test-connection", "Connect to every database, run a test query, print the outcome and exit.").Default("false").Bool()
+	textfileOutput   = app.Flag("textfile-output", "Scrape once, write the metrics in the Prometheus text format to this file and exit.").Default("").String()
+	pushGatewayURL   = app.Flag("push.gateway-url", "Scrape once, push the metrics to this Pushgateway URL and exit.").Default("").String()
+	pushJob          = app.Flag("push.job", "Job name used when pushing to the Pushgateway.").Default("oracledb_exporter").String()
+	dsnOptions       = app.Flag("database.dsn-options", "oci8 connection parameter (key=value) added to every DSN unless the DSN sets it, e.g. prefetch_rows=500. Can be repeated.").StringMap()
+	dataSourceNames  = app.Flag("dsn", "The data source names (DSNs) comma separated strings like: system/blabla@docker.for.mac.localhost:1521/DINTDB. Only use it if you don't use SSM parameters.").Envar("DATA_SOURCE_NAME").String()
 
-	dataSourceNames = app.Flag("dsn", "The data source names (DSNs) comma separated strings like: system/blabla@docker.for.mac.localhost:1521/DINTDB. Only use it if you don't use SSM parameters.").Envar("DATA_SOURCE_NAME").String()
+	secretBackend = app.Flag("secret.backend", "Secret backend holding the connection settings when no DSN is given (ssm or conjur).").Default("ssm").Enum("ssm", "conjur")
+	conjurPrefix  = app.Flag("conjur.prefix", "The Conjur variable prefix, required with the conjur secret backend. The variables are named like the ssm parameters.").String()
 
 	// aws ssm related flags
 	awsRegion   = app.Flag("aws.region", "The aws region to use").Default("eu-central-1").String()
-	ssmPrefix   = app.Flag("ssm.prefix", "The ssm parameter prefix").Required().String()
+	ssmPrefix   = app.Flag("ssm.prefix", "The ssm parameter prefix, required when no DSN is given").String()
 	ssmUser     = app.Flag("ssm.user", "The ssm parameter to get the oracle user").Default("monitoring-user").String()
 	ssmPassword = app.Flag("ssm.password", "The ssm parameter to get the oracle password").Default("monitoring-password").String()
 	ssmPort     = app.Flag("ssm.port", "The ssm parameter to get the oracle port").Default("port").String()
 	ssmSIDs     = app.Flag("ssm.sids", "The ssm parameter to get the oracle sids comma separated list").Default("sids").String()
 	ssmHost     = app.Flag("ssm.host", "The ssm parameter to get the oracle host").Default("host").String()
 
-	queryTimeout = app.Flag("query.timeout", "Query timeout (in seconds).").Default("5").Int()
+	queryLabel        = app.Flag("debug.query-label", "Add the query of each metric as the exporter_query label, for debugging only: off, hash, truncated or full.").Default("off").Enum("off", "hash", "truncated", "full")
+	upSIDLabel        = app.Flag("up.sid-label", "When the up metric has the sid label: always, multi (only with several databases) or never (1 only if all the databases are up).").Default("always").Enum("always", "multi", "never")
+	mode              = app.Flag("mode", "Scrape mode: full scrapes all the metrics, availability only checks whether the databases are up.").Default("full").Enum("full", "availability")
+	queryTimeout      = app.Flag("query.timeout", "Query timeout (in seconds).").Default("5").Int()
+	numberSeparators  = app.Flag("query.group-separators", "Characters stripped from the values before they are parsed as numbers, like the group separators of numbers formatted as 1,234,567 (empty to keep them).").Default("").String()
+	queryMaxRows      = app.Flag("query.max-rows", "Maximum number of rows read from a query result (0 for no limit).").Default("0").Int()
+	connMaxLifetime   = app.Flag("database.conn-max-lifetime", "Maximum lifetime of a database connection (in seconds).").Default("60").Int()
+	warmupConcurrency = app.Flag("database.warmup-concurrency", "Number of databases connected to in parallel at startup, before the first scrape (0 to connect on the first scrape).").Default("0").Int()
+	warmupTimeout     = app.Flag("database.warmup-timeout", "Time allowed to connect to all the databases at startup (in seconds).").Default("60").Int()
+	keepaliveInterval = app.Flag("database.keepalive-interval", "Interval to ping idle connections to keep them open (in seconds, 0 to disable).").Default("0").Int()
+	connectTimeout    = app.Flag("database.connect-timeout", "Oracle Net timeout to establish a connection, including the session setup (in seconds, 0 to use the Oracle Net default).").Default("0").Int()
+	transportTimeout  = app.Flag("database.transport-connect-timeout", "Oracle Net timeout to establish the TCP connection (in seconds, 0 to use the Oracle Net default).").Default("0").Int()
+	identityQuery     = app.Flag("database.identity-query", "Query returning the value of the sid label of the scraped metrics of a database, like SELECT instance_name FROM v$instance (empty to use the SID of the data source name).").Default("").String()
+	validationQuery   = app.Flag("database.validation-query", "Query run at the start of every scrape of a database, up is 1 only if it succeeds (empty to only ping the database).").Default("SELECT 1 FROM dual").String()
+	dedicatedPoolSize = app.Flag("database.dedicated-pool-size", "Maximum number of connections per database of the pool used by the metrics with dedicated set.").Default("1").Int()
+	authBackoff       = app.Flag("database.auth-backoff", "Time a database isn't logged in to after a failed login, unless its credentials change (in seconds, 0 to disable).").Default("300").Int()
+	acquireTimeout    = app.Flag("database.acquire-timeout", "Timeout to acquire a free database connection (in seconds).").Default("5").Int()
+	scrapeTimeout     = app.Flag("scrape.timeout", "Time budget to scrape the metrics of a database (in seconds, 0 for no limit). Metrics left when it is exhausted are skipped.").Default("0").Int()
+	duplicateSIDs     = app.Flag("database.duplicate-sids", "What to do with a SID configured several times: error out, or keep only its first data source.").Default("error").Enum("error", "first")
+	scrapeSIDs        = app.Flag("scrape.sids", "Comma separated list of the SIDs to scrape among the configured ones (empty for all).").Default("").String()
+	errorMode         = app.Flag("scrape.error-mode", "What sets last_scrape_error: any failure of the scrape, or only connection failures.").Default("any").Enum("any", "connection")
+	failureGrace      = app.Flag("scrape.failure-grace", "Number of consecutive failed scrapes of a database before up drops to 0, up keeps its last value in between.").Default("1").Int()
+	scrapeConcurrency = app.Flag("scrape.concurrency", "Maximum number of databases scraped concurrently (0 to size it from the CPU quota).").Default("0").Int()
+
+	haLockName     = app.Flag("ha.lock-name", "Name of the Oracle user lock elected replicas take to scrape the metrics, only the holder scrapes them (empty to disable).").Default("").String()
+	haLockInterval = app.Flag("ha.lock-interval", "Interval to request the scrape lock (in seconds).").Default("10").Int()
+
+	labelMappingFile = app.Flag("label.mapping-file", "TOML file mapping SIDs to additional labels added to their metrics.").Default("").String()
+	databaseGroups   = app.Flag("label.database", "Logical database shared by the comma separated SIDs, added to their metrics as the database label (database=sid,...). Can be repeated.").StringMap()
+	disableSIDLabel  = app.Flag("label.disable-sid", "Do not add the sid label to the scraped metrics.").Default("false").Bool()
+
+	currentSchema = app.Flag("database.current-schema", "Schema used to resolve unqualified object names in the queries.").Default("").String()
+	consumerGroup = app.Flag("database.consumer-group", "Resource Manager consumer group the sessions of the exporter switch to on connect (empty to keep the initial group).").Default("").String()
+
+	databaseRole = app.Flag("database.role", "Role of the scraped databases (primary or standby). Metrics marked as primaryonly are skipped on a standby.").Default("primary").Enum("primary", "standby")
+
+	errorClassification = app.Flag("error.classification", "Comma separated mapping of Oracle error codes to scrape states (up, degraded, starting, down), e.g. ORA-01033=starting.").Default("ORA-01033=starting,ORA-01034=starting,ORA-03113=down,ORA-03114=down,ORA-12514=down,ORA-12541=down").String()
 )
 
 // Metric name parts.
@@ -54,15 +135,86 @@ const (
 	exporter  = "exporter"
 )
 
+// Scrape states of a SID, ordered by increasing severity.
+const (
+	stateUp       = "up"
+	stateDegraded = "degraded"
+	stateStarting = "starting"
+	stateDown     = "down"
+)
+
+var scrapeStates = []string{stateUp, stateDegraded, stateStarting, stateDown}
+
+// connWait tracks the time queries spend waiting for a free connection.
+var connWait = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: namespace,
+	Subsystem: exporter,
+	Name:      "conn_wait_seconds",
+	Help:      "Time spent waiting to acquire a database connection.",
+}, []string{"sid"})
+
+// startTime is the time the exporter started at, to compute its uptime.
+var startTime = prometheus.NewGauge(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Subsystem: exporter,
+	Name:      "start_time_seconds",
+	Help:      "Start time of the exporter since unix epoch in seconds.",
+})
+
+// scrapeParseErrors tracks the values dropped by the last scrape of a metric
+// because they couldn't be parsed.
+var scrapeParseErrors = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Subsystem: exporter,
+	Name:      "scrape_parse_errors",
+	Help:      "Number of values skipped by the last scrape of the metric because they could not be parsed.",
+}, []string{"collector", "index", "sid"})
+
+var oraErrorCode = regexp.MustCompile(`ORA-\d{5}`)
+
 // Metric object description
 type Metric struct {
-	Context          string
-	Labels           []string
-	MetricsType      map[string]string
-	MetricsDesc      map[string]string
-	FieldToAppend    string
-	Request          string
-	IgnoreZeroResult bool
+	Context            string              `json:"context,omitempty"`
+	Labels             []string            `json:"labels,omitempty"`
+	MetricsType        map[string]string   `json:"metricstype,omitempty"`
+	MetricsDesc        map[string]string   `json:"metricsdesc,omitempty"`
+	FieldToAppend      string              `json:"fieldtoappend,omitempty"`
+	FieldLabel         string              `json:"fieldlabel,omitempty"`
+	Request            string              `json:"request,omitempty"`
+	GuardQuery         string              `json:"guardquery,omitempty"`
+	Rate               bool                `json:"rate,omitempty"`
+	RequiresOpen       bool                `json:"requiresopen,omitempty"`
+	Dedicated          bool                `json:"dedicated,omitempty"`
+	IgnoreZeroResult   bool                `json:"ignorezeroresult,omitempty"`
+	PrimaryOnly        bool                `json:"primaryonly,omitempty"`
+	TimeUnit           string              `json:"timeunit,omitempty"`
+	OnParseError       string              `json:"onparseerror,omitempty"`
+	Disabled           bool                `json:"disabled,omitempty"`
+	MaxSeries          int                 `json:"maxseries,omitempty"`
+	BackgroundInterval duration            `json:"backgroundinterval,omitempty"`
+	StaleAfter         duration            `json:"staleafter,omitempty"`
+	SingleRow          bool                `json:"singlerow,omitempty"`
+	MaxRows            int                 `json:"maxrows,omitempty"`
+	Priority           int                 `json:"priority,omitempty"`
+	Name               string              `json:"name,omitempty"`
+	Help               string              `json:"help,omitempty"`
+	Type               string              `json:"type,omitempty"`
+	KeyColumn          string              `json:"keycolumn,omitempty"`
+	ValueColumn        string              `json:"valuecolumn,omitempty"`
+	PDBLabel           bool                `json:"pdblabel,omitempty"`
+	Prefix             string              `json:"prefix,omitempty"`
+	HashLabels         []string            `json:"hashlabels,omitempty"`
+	LabelFilter        map[string][]string `json:"labelfilter,omitempty"`
+	LabelValues        map[string]string   `json:"labelvalues,omitempty"`
+	JSONPaths          map[string]string   `json:"jsonpaths,omitempty"`
+	ValueTypes         map[string]string   `json:"valuetypes,omitempty"`
+	GroupSeparators    string              `json:"groupseparators,omitempty"`
+	ColumnCase         string              `json:"columncase,omitempty"`
+	ResultSets         map[string]*Metric  `json:"resultsets,omitempty"`
+
+	// index tells apart the definitions sharing a context, in the order
+	// they were loaded.
+	index int
 }
 
 // Exporter collects Oracle DB metrics. It implements prometheus.Collector.
@@ -70,33 +222,52 @@ type Exporter struct {
 	dbEnvs         []*dbEnvironment
 	metricsToScrap []*Metric
 	duration       *prometheus.GaugeVec
+	overran        *prometheus.GaugeVec
+	maintenance    *prometheus.GaugeVec
 	err            *prometheus.GaugeVec
 	totalScrapes   *prometheus.CounterVec
 	scrapeErrors   *prometheus.CounterVec
+	emptyResults   *prometheus.CounterVec
+	byCollector    *prometheus.CounterVec
+	failedMetrics  *prometheus.GaugeVec
 	up             *prometheus.GaugeVec
+	upError        *prometheus.GaugeVec
+	state          *prometheus.GaugeVec
+	timeOffset     *prometheus.GaugeVec
+	openMode       *prometheus.GaugeVec
+	errorClasses   map[string]string
+	cache          map[string]*cachedScrape
+	cacheAge       *prometheus.GaugeVec
+	cacheMtx       sync.Mutex
+	states         map[string]string
+	statesMtx      sync.Mutex
+	globalUp       bool
+	upBySID        map[string]float64
+	upFailures     map[string]int
+	// mtx is held for reading by scrapes and for writing by Reload, so that
+	// a reload waits for the in-flight scrapes.
+	mtx            sync.RWMutex
+	stopBackground chan struct{}
 }
 
 // NewExporter returns a new Oracle DB exporter for the provided DSN.
+// The databases of dbEnvs must be open, several exporters may share them.
 func NewExporter(dbEnvs []*dbEnvironment, metrics []*Metric) *Exporter {
-	for _, env := range dbEnvs {
-		var err error
-		env.db, err = sql.Open("oci8", env.dsn)
-		if err != nil {
-			log.Fatalf("unable to connect to: %s, failed with: %s", env.dsn, err)
-		}
-		// By design exporter should use maximum one connection per request.
-		env.db.SetMaxOpenConns(1)
-		env.db.SetMaxIdleConns(1)
-		// Set max lifetime for a connection.
-		env.db.SetConnMaxLifetime(1 * time.Minute)
+	errorClasses, err := parseErrorClassification(*errorClassification)
+	if err != nil {
+		log.Fatalf("invalid error classification: %s", err)
 	}
 
-	// adding env label to all metrics
-	for _, metric := range metrics {
-		metric.Labels = append(metric.Labels, "sid")
+	prepareMetrics(metrics)
+
+	// up may be global rather than per SID
+	globalUp := *upSIDLabel == "never" || (*upSIDLabel == "multi" && len(dbEnvs) == 1)
+	upLabels := []string{"sid"}
+	if globalUp {
+		upLabels = nil
 	}
 
-	return &Exporter{
+	e := &Exporter{
 		metricsToScrap: metrics,
 		duration: prometheus.NewGaugeVec(prometheus.GaugeOpts{
 			Namespace: namespace,
@@ -104,6 +275,17 @@ func NewExporter(dbEnvs []*dbEnvironment, metrics []*Metric) *Exporter {
 			Name:      "last_scrape_duration_seconds",
 			Help:      "Duration of the last scrape of metrics from Oracle DB.",
 		}, []string{"sid"}),
+		overran: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: exporter,
+			Name:      "scrape_timeout_exceeded",
+			Help:      "Whether the last scrape of Oracle DB outlasted the scrape timeout of the request (1 for yes, 0 for no).",
+		}, []string{"sid"}),
+		maintenance: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "maintenance",
+			Help:      "Whether the database is in a maintenance window and isn't scraped (1 for yes, 0 for no).",
+		}, []string{"sid"}),
 		totalScrapes: prometheus.NewCounterVec(prometheus.CounterOpts{
 			Namespace: namespace,
 			Subsystem: exporter,
@@ -116,6 +298,24 @@ func NewExporter(dbEnvs []*dbEnvironment, metrics []*Metric) *Exporter {
 			Name:      "scrape_errors_total",
 			Help:      "Total number of times an error occured scraping a Oracle database.",
 		}, []string{"collector", "sid"}),
+		emptyResults: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: exporter,
+			Name:      "empty_result_total",
+			Help:      "Total number of times the query of a metric ran fine but returned no values.",
+		}, []string{"collector", "sid"}),
+		byCollector: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: exporter,
+			Name:      "scrapes_by_collector_total",
+			Help:      "Total number of scrapes of the collector by result (success or error).",
+		}, []string{"collector", "sid", "result"}),
+		failedMetrics: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: exporter,
+			Name:      "last_scrape_failed_metrics",
+			Help:      "Number of metrics whose query failed during the last scrape of Oracle DB.",
+		}, []string{"sid"}),
 		err: prometheus.NewGaugeVec(prometheus.GaugeOpts{
 			Namespace: namespace,
 			Subsystem: exporter,
@@ -126,10 +326,142 @@ func NewExporter(dbEnvs []*dbEnvironment, metrics []*Metric) *Exporter {
 			Namespace: namespace,
 			Name:      "up",
 			Help:      "Whether the Oracle database server is up.",
+		}, upLabels),
+		upError: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "up_error",
+			Help:      "Whether the Oracle database server is unreachable for the given reason (1 for yes, 0 for no).",
+		}, []string{"sid", "reason"}),
+		state: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "state",
+			Help:      "Current scrape state of the Oracle database (1 for the active state, 0 otherwise).",
+		}, []string{"sid", "state"}),
+		timeOffset: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "time_offset_seconds",
+			Help:      "Difference between the clock of the Oracle database and the clock of the exporter.",
 		}, []string{"sid"}),
-		dbEnvs: dbEnvs,
+		openMode: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "open_mode",
+			Help:      "Open mode of the Oracle database (1 for the current mode, 0 otherwise).",
+		}, []string{"sid", "mode"}),
+		cacheAge: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: exporter,
+			Name:      "cached_result_age_seconds",
+			Help:      "Time since the served result of a background scraped metric was queried from Oracle DB.",
+		}, []string{"collector", "sid"}),
+		errorClasses: errorClasses,
+		cache:        make(map[string]*cachedScrape),
+		states:       make(map[string]string),
+		globalUp:     globalUp,
+		upBySID:      make(map[string]float64),
+		upFailures:   make(map[string]int),
+		dbEnvs:       dbEnvs,
+	}
+	e.startBackgroundScrapes()
+	return e
+}
+
+// prepareMetrics orders metrics by priority and adds the sid label.
+func prepareMetrics(metrics []*Metric) {
+	// Scrape metrics with a higher priority first
+	sort.SliceStable(metrics, func(i, j int) bool {
+		return metrics[i].Priority > metrics[j].Priority
+	})
+
+	// adding env label to all metrics
+	if !*disableSIDLabel {
+		for _, metric := range metrics {
+			metric.Labels = append(metric.Labels, "sid")
+			for _, set := range metric.ResultSets {
+				set.Labels = append(set.Labels, "sid")
+			}
+		}
+	}
+}
+
+// Reload replaces the databases and metrics scraped by e. It waits for the
+// in-flight scrapes, which complete against the previous configuration, and
+// restarts the background scrapes.
+func (e *Exporter) Reload(dbEnvs []*dbEnvironment, metrics []*Metric) {
+	prepareMetrics(metrics)
+
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	close(e.stopBackground)
+	e.cacheMtx.Lock()
+	e.cache = make(map[string]*cachedScrape)
+	e.cacheMtx.Unlock()
+
+	kept := make(map[string]bool)
+	for _, env := range dbEnvs {
+		kept[env.sid] = true
+	}
+	for _, env := range e.dbEnvs {
+		if !kept[env.sid] {
+			e.forgetSID(env.sid)
+		}
+	}
+	e.dbEnvs, e.metricsToScrap = dbEnvs, metrics
+	e.startBackgroundScrapes()
+}
+
+// forgetSID drops the state and the per SID series of a database that is no
+// longer scraped.
+func (e *Exporter) forgetSID(sid string) {
+	e.statesMtx.Lock()
+	delete(e.states, sid)
+	delete(e.upBySID, sid)
+	delete(e.upFailures, sid)
+	e.statesMtx.Unlock()
+	vecs := []sidVec{
+		e.duration, e.overran, e.maintenance, e.err, e.totalScrapes, e.scrapeErrors,
+		e.emptyResults, e.byCollector, e.failedMetrics, e.upError, e.state, e.timeOffset,
+		e.openMode, e.cacheAge, connWait, scrapeParseErrors, queryTimeouts,
+	}
+	if !e.globalUp {
+		vecs = append(vecs, e.up)
 	}
+	for _, vec := range vecs {
+		deleteSID(vec, sid)
+	}
+}
+
+// sidVec is a metric vector with a sid label.
+type sidVec interface {
+	prometheus.Collector
+	Delete(labels prometheus.Labels) bool
+}
 
+// deleteSID deletes the series of vec whose sid label is sid, whatever their
+// other labels.
+func deleteSID(vec sidVec, sid string) {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		vec.Collect(ch)
+		close(ch)
+	}()
+	// The vector can't be changed while it is collected.
+	var stale []prometheus.Labels
+	for m := range ch {
+		var metric dto.Metric
+		if err := m.Write(&metric); err != nil {
+			continue
+		}
+		labels := prometheus.Labels{}
+		for _, pair := range metric.Label {
+			labels[pair.GetName()] = pair.GetValue()
+		}
+		if labels["sid"] == sid {
+			stale = append(stale, labels)
+		}
+	}
+	for _, labels := range stale {
+		vec.Delete(labels)
+	}
 }
 
 // Describe describes all the metrics exported by the SQL exporter.
@@ -163,60 +495,410 @@ func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
 
 // Collect implements prometheus.Collector.
 func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
+	e.collect(ch, time.Time{})
+}
+
+// collect scrapes the databases. requestDeadline is the time the scrape
+// request times out at, it is zero when unknown.
+func (e *Exporter) collect(ch chan<- prometheus.Metric, requestDeadline time.Time) {
+	e.mtx.RLock()
+	defer e.mtx.RUnlock()
 	var wg sync.WaitGroup
+	sem := make(chan struct{}, scrapeParallelism())
 	for _, env := range e.dbEnvs {
 		wg.Add(1)
-		go e.scrapeEnv(env, ch, &wg)
+		sem <- struct{}{}
+		go func(env *dbEnvironment) {
+			defer func() { <-sem }()
+			e.scrapeEnv(env, ch, &wg, requestDeadline)
+		}(env)
 	}
 	wg.Wait()
 	e.duration.Collect(ch)
+	e.overran.Collect(ch)
+	e.maintenance.Collect(ch)
 	e.totalScrapes.Collect(ch)
 	e.err.Collect(ch)
 	e.scrapeErrors.Collect(ch)
+	e.emptyResults.Collect(ch)
+	e.byCollector.Collect(ch)
+	e.failedMetrics.Collect(ch)
 	e.up.Collect(ch)
+	e.upError.Collect(ch)
+	e.state.Collect(ch)
+	e.timeOffset.Collect(ch)
+	e.openMode.Collect(ch)
+	e.cacheAge.Collect(ch)
+	connWait.Collect(ch)
+	connectDuration.Collect(ch)
+	customFileStatus.Collect(ch)
+	metricsLoaded.Collect(ch)
+	configHash.Collect(ch)
+	scrapeParseErrors.Collect(ch)
+	queryTimeouts.Collect(ch)
+	labelChanges.Collect(ch)
+	leader.Collect(ch)
+	startTime.Collect(ch)
 }
 
-func (e *Exporter) scrapeEnv(env *dbEnvironment, ch chan<- prometheus.Metric, wg *sync.WaitGroup) {
+func (e *Exporter) scrapeEnv(env *dbEnvironment, ch chan<- prometheus.Metric, wg *sync.WaitGroup, requestDeadline time.Time) {
+	if env.inMaintenance(time.Now()) {
+		// The other metrics of the SID keep their last values.
+		log.Debugf("SID: %s is in a maintenance window, skipping the scrape", env.sid)
+		e.maintenance.WithLabelValues(env.sid).Set(1)
+		wg.Done()
+		return
+	}
+	e.maintenance.WithLabelValues(env.sid).Set(0)
 	e.totalScrapes.WithLabelValues(env.sid).Inc()
-	var err error
+	var err, connErr error
+	var failedMetrics int
+	state := stateUp
+	var deadline time.Time
+	if *scrapeTimeout > 0 {
+		deadline = time.Now().Add(time.Duration(*scrapeTimeout) * time.Second)
+	}
 	defer func(start time.Time) {
 		e.duration.WithLabelValues(env.sid).Set(time.Since(start).Seconds())
-		if err == nil {
+		if !requestDeadline.IsZero() {
+			if time.Now().After(requestDeadline) {
+				log.Warnf("scrape of SID: %s exceeded the scrape timeout of the request", env.sid)
+				e.overran.WithLabelValues(env.sid).Set(1)
+			} else {
+				e.overran.WithLabelValues(env.sid).Set(0)
+			}
+		}
+		scrapeErr := err
+		if *errorMode == "connection" {
+			scrapeErr = connErr
+		}
+		if scrapeErr == nil {
 			e.err.WithLabelValues(env.sid).Set(0)
 		} else {
 			e.err.WithLabelValues(env.sid).Set(1)
 		}
+		e.failedMetrics.WithLabelValues(env.sid).Set(float64(failedMetrics))
+		e.setState(env.sid, state)
 		wg.Done()
 	}(time.Now())
 
-	if err = env.db.Ping(); err != nil {
+	if env.inAuthBackoff() && env.credentials != nil {
+		// New credentials end the backoff.
+		if err := refreshCredentials(env); err != nil {
+			log.Errorf("failed to refresh the credentials of SID: %s with: %s", env.sid, err)
+		}
+	}
+	if env.inAuthBackoff() {
+		log.Debugf("SID: %s is in the backoff after a failed login, skipping the scrape", env.sid)
+		err = errors.New("login suspended after a failed login")
+		connErr = err
+		e.setUp(env.sid, 0)
+		state = stateDown
+		return
+	}
+	err = validateConnection(env)
+	connErr = err
+	if isAuthError(err) {
+		// Don't run the queries, each of them would try to log in again and
+		// repeated failed logins may lock the account.
+		log.Errorf("login to oracle failed SID: %s, with error: %s", env.sid, err)
+		e.setUp(env.sid, 0)
+		e.upError.WithLabelValues(env.sid, "auth_failed").Set(1)
+		state = stateDown
+		env.setAuthFailed()
+		if env.credentials != nil {
+			if err := refreshCredentials(env); err != nil {
+				log.Errorf("failed to refresh the credentials of SID: %s with: %s", env.sid, err)
+			}
+		}
+		return
+	}
+	e.upError.WithLabelValues(env.sid, "auth_failed").Set(0)
+	if err != nil {
+		state = e.classifyError(err, stateDown)
 		if strings.Contains(err.Error(), "sql: database is closed") {
 			log.Infof("reconnecting to DB SID: %s", env.sid)
-			env.db, err = sql.Open("oci8", env.dsn)
+			err = env.reopen(env.currentDSN())
+			connErr = err
 
 			if err != nil {
-				log.Errorf("pinging oracle failed SID: %s connection string: %s, with error: %s", env.sid, env.dsn, err)
-				env.db.Close()
-				e.up.WithLabelValues(env.sid).Set(0)
+				log.Errorf("pinging oracle failed SID: %s connection string: %s, with error: %s", env.sid, redactDSN(env.currentDSN()), err)
+				e.setUp(env.sid, 0)
+				state = stateDown
 				return
 			}
 
-			// By design exporter should use maximum one connection per request.
-			env.db.SetMaxOpenConns(1)
-			env.db.SetMaxIdleConns(1)
-			// Set max lifetime for a connection.
-			env.db.SetConnMaxLifetime(2 * time.Minute)
+			err = validateConnection(env)
+			connErr = err
+		}
+		if err != nil && state == stateStarting {
+			// The instance opens shortly, don't report it as a failure.
+			log.Infof("oracle instance of SID: %s is starting up, skipping the scrape: %s", env.sid, err)
+			e.setUp(env.sid, 0)
+			e.upError.WithLabelValues(env.sid, "starting").Set(1)
+			return
+		}
+		if err != nil {
+			log.Errorf("connection validation failed SID: %s, with error: %s", env.sid, err)
+			e.setUp(env.sid, 0)
+			e.upError.WithLabelValues(env.sid, "starting").Set(0)
+			return
 		}
+		state = stateUp
 	}
+	e.upError.WithLabelValues(env.sid, "starting").Set(0)
 
-	e.up.WithLabelValues(env.sid).Set(1)
-	for _, metric := range e.metricsToScrap {
+	e.setUp(env.sid, 1)
+	if *mode == "availability" {
+		return
+	}
+	if !env.isLeader() {
+		log.Debugf("not the leader of SID: %s, skipping the metrics", env.sid)
+		return
+	}
+	if err = env.resolveIdentity(); err != nil {
+		// Metrics labelled with the SID would be new series for the same
+		// database, skip them until the identity is known.
+		log.Errorf("identity query failed SID: %s, skipping the metrics: %s", env.sid, err)
+		e.countScrape("identity", env.sid, err)
+		e.scrapeErrors.WithLabelValues("identity", env.sid).Inc()
+		state = worseState(state, stateDegraded)
+		return
+	}
+	err = e.scrapeTimeOffset(env)
+	e.countScrape("time_offset", env.sid, err)
+	if err != nil {
+		log.Errorln("error scraping for time_offset :", err)
+		e.scrapeErrors.WithLabelValues("time_offset", env.sid).Inc()
+	}
+	openMode, err := e.scrapeOpenMode(env)
+	e.countScrape("open_mode", env.sid, err)
+	if err != nil {
+		log.Errorln("error scraping for open_mode :", err)
+		e.scrapeErrors.WithLabelValues("open_mode", env.sid).Inc()
+	}
+	for i, metric := range e.metricsToScrap {
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			log.Warnf("scrape timeout exceeded for SID: %s, skipping %d metrics", env.sid, len(e.metricsToScrap)-i)
+			state = worseState(state, stateDegraded)
+			break
+		}
+		if metric.PrimaryOnly && *databaseRole == "standby" {
+			log.Debugf("skipping primary only metric: %s", metric.Context)
+			continue
+		}
+		if openMode == "MOUNTED" && requiresOpen(metric) {
+			log.Debugf("skipping metric: %s, the database is mounted but not open", metric.Context)
+			continue
+		}
+		if metric.BackgroundInterval.Duration > 0 {
+			e.collectCached(env, metric, ch)
+			continue
+		}
 		log.Debugf("scrape metric: %s", metric.Context)
-		if err = ScrapeMetric(env.sid, env.db, ch, metric); err != nil {
+		err = ScrapeMetric(env, ch, metric)
+		e.countScrape(metric.Context, env.sid, err)
+		if isEmptyResult(err) {
+			// The query ran fine, it is counted apart from the failures.
+			log.Warnln("empty result for", metric.Context, ":", err)
+			e.emptyResults.WithLabelValues(metric.Context, env.sid).Inc()
+		} else if err != nil {
 			log.Errorln("error scraping for", metric.Context, ":", err)
 			e.scrapeErrors.WithLabelValues(metric.Context, env.sid).Inc()
+			failedMetrics++
+			state = worseState(state, e.classifyError(err, stateDegraded))
+		}
+	}
+}
+
+const timeOffsetQuery = `SELECT (CAST(SYS_EXTRACT_UTC(SYSTIMESTAMP) AS DATE) - DATE '1970-01-01') * 86400
+  + MOD(EXTRACT(SECOND FROM SYSTIMESTAMP), 1) FROM dual`
+
+// scrapeTimeOffset compares the database clock with the exporter clock. The
+// exporter time is taken in the middle of the round trip.
+func (e *Exporter) scrapeTimeOffset(env *dbEnvironment) error {
+	ctx, cancel := context.WithTimeout(context.Background(), env.timeout())
+	defer cancel()
+	db, release := env.database()
+	defer release()
+	var dbTime float64
+	start := time.Now()
+	if err := db.QueryRowContext(ctx, timeOffsetQuery).Scan(&dbTime); err != nil {
+		return err
+	}
+	end := time.Now()
+	localTime := start.Add(end.Sub(start) / 2)
+	e.timeOffset.WithLabelValues(env.sid).Set(dbTime - float64(localTime.UnixNano())/1e9)
+	return nil
+}
+
+// Open modes of v$database.
+var openModes = []string{"MOUNTED", "READ WRITE", "READ ONLY", "READ ONLY WITH APPLY", "MIGRATE"}
+
+// scrapeOpenMode exports the open mode of the database and returns it.
+func (e *Exporter) scrapeOpenMode(env *dbEnvironment) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), env.timeout())
+	defer cancel()
+	db, release := env.database()
+	defer release()
+	var openMode string
+	if err := db.QueryRowContext(ctx, "SELECT open_mode FROM v$database").Scan(&openMode); err != nil {
+		return "", err
+	}
+	known := false
+	for _, mode := range openModes {
+		if mode == openMode {
+			known = true
+			e.openMode.WithLabelValues(env.sid, mode).Set(1)
+		} else {
+			e.openMode.WithLabelValues(env.sid, mode).Set(0)
+		}
+	}
+	if !known {
+		e.openMode.WithLabelValues(env.sid, openMode).Set(1)
+	}
+	return openMode, nil
+}
+
+// dictionaryView matches the data dictionary views, which can't be queried
+// before the database is open.
+var dictionaryView = regexp.MustCompile(`(?i)\b(dba|cdb)_\w+`)
+
+// requiresOpen reports whether metric needs an open database.
+func requiresOpen(metric *Metric) bool {
+	return metric.RequiresOpen || dictionaryView.MatchString(metric.Request) || dictionaryView.MatchString(metric.GuardQuery)
+}
+
+// scrapeParallelism returns the number of databases that may be scraped at
+// the same time. GOMAXPROCS is aligned to the container CPU quota at startup.
+func scrapeParallelism() int {
+	if *scrapeConcurrency > 0 {
+		return *scrapeConcurrency
+	}
+	return runtime.GOMAXPROCS(0)
+}
+
+// parseErrorClassification parses a comma separated list of ORA-XXXXX=state
+// pairs into a map of Oracle error code to scrape state.
+func parseErrorClassification(s string) (map[string]string, error) {
+	classes := make(map[string]string)
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || !oraErrorCode.MatchString(parts[0]) {
+			return nil, fmt.Errorf("unable to parse error classification entry: %s", entry)
+		}
+		state := strings.ToLower(strings.TrimSpace(parts[1]))
+		if stateSeverity(state) < 0 {
+			return nil, fmt.Errorf("unknown scrape state: %s for error code: %s", state, parts[0])
+		}
+		classes[strings.ToUpper(strings.TrimSpace(parts[0]))] = state
+	}
+	return classes, nil
+}
+
+// isAuthError reports whether err is an invalid username or password error.
+func isAuthError(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "ORA-01017")
+}
+
+// countScrape counts a scrape of collector by its result.
+func (e *Exporter) countScrape(collector string, sid string, err error) {
+	result := "success"
+	if isEmptyResult(err) {
+		result = "empty"
+	} else if err != nil {
+		result = "error"
+	}
+	e.byCollector.WithLabelValues(collector, sid, result).Inc()
+}
+
+// classifyError returns the scrape state mapped to the Oracle error code found
+// in err, or fallback if err carries no classified code.
+func (e *Exporter) classifyError(err error, fallback string) string {
+	if code := oraErrorCode.FindString(err.Error()); code != "" {
+		if state, ok := e.errorClasses[code]; ok {
+			return state
+		}
+	}
+	return fallback
+}
+
+// setState marks state as the active scrape state of the given SID.
+func (e *Exporter) setState(sid string, state string) {
+	e.statesMtx.Lock()
+	e.states[sid] = state
+	e.statesMtx.Unlock()
+	for _, s := range scrapeStates {
+		if s == state {
+			e.state.WithLabelValues(sid, s).Set(1)
+		} else {
+			e.state.WithLabelValues(sid, s).Set(0)
+		}
+	}
+}
+
+// setUp sets the up metric of sid. A global up metric is 1 only if all the
+// databases are up. Once up, a database is reported down only after
+// scrape.failure-grace consecutive failures.
+func (e *Exporter) setUp(sid string, value float64) {
+	e.statesMtx.Lock()
+	defer e.statesMtx.Unlock()
+	// Debounce the failures of a database that was up
+	if value == 0 {
+		e.upFailures[sid]++
+		if e.upBySID[sid] == 1 && e.upFailures[sid] < *failureGrace {
+			log.Infof("scrape of SID: %s failed %d consecutive times, up stays 1 until %d", sid, e.upFailures[sid], *failureGrace)
+			return
+		}
+	} else {
+		delete(e.upFailures, sid)
+	}
+	e.upBySID[sid] = value
+	if !e.globalUp {
+		e.up.WithLabelValues(sid).Set(value)
+		return
+	}
+	up := 1.0
+	for _, v := range e.upBySID {
+		if v < up {
+			up = v
+		}
+	}
+	e.up.WithLabelValues().Set(up)
+}
+
+// allDown reports whether none of the databases could be scraped.
+func (e *Exporter) allDown() bool {
+	e.mtx.RLock()
+	defer e.mtx.RUnlock()
+	e.statesMtx.Lock()
+	defer e.statesMtx.Unlock()
+	for _, env := range e.dbEnvs {
+		if state := e.states[env.sid]; state != stateDown && state != stateStarting {
+			return false
+		}
+	}
+	return true
+}
+
+func stateSeverity(state string) int {
+	for i, s := range scrapeStates {
+		if s == state {
+			return i
 		}
 	}
+	return -1
+}
+
+func worseState(a, b string) string {
+	if stateSeverity(b) > stateSeverity(a) {
+		return b
+	}
+	return a
 }
 
 // GetMetricType omg omg omg
@@ -226,7 +908,10 @@ func GetMetricType(metricType string, metricsType map[string]string) prometheus.
 		"counter": prometheus.CounterValue,
 	}
 
-	strType, ok := metricsType[strings.ToLower(metricType)]
+	strType, ok := metricsType[metricType]
+	if !ok {
+		strType, ok = metricsType[strings.ToLower(metricType)]
+	}
 	if !ok {
 		return prometheus.GaugeValue
 	}
@@ -238,123 +923,778 @@ func GetMetricType(metricType string, metricsType map[string]string) prometheus.
 }
 
 // ScrapeMetric interface method to call ScrapeGenericValues using Metric struct values
-func ScrapeMetric(env string, db *sql.DB, ch chan<- prometheus.Metric, metricDefinition *Metric) error {
+func ScrapeMetric(env *dbEnvironment, ch chan<- prometheus.Metric, metricDefinition *Metric) error {
+	err := scrapeMetric(env, ch, metricDefinition)
+	var timeoutErr *queryTimeoutError
+	if errors.As(err, &timeoutErr) {
+		timeoutErr.context = metricDefinition.Context
+		queryTimeouts.WithLabelValues(metricDefinition.Context, env.sid).Inc()
+	}
+	return err
+}
+
+func scrapeMetric(env *dbEnvironment, ch chan<- prometheus.Metric, metricDefinition *Metric) error {
 	log.Debugln("scrape metric")
-	return ScrapeGenericValues(env, db, ch, metricDefinition.Context, metricDefinition.Labels,
-		metricDefinition.MetricsDesc, metricDefinition.MetricsType,
-		metricDefinition.FieldToAppend, metricDefinition.IgnoreZeroResult,
-		metricDefinition.Request)
+	if metricDefinition.GuardQuery != "" {
+		pass, err := checkGuard(env, metricDefinition.GuardQuery)
+		if err != nil {
+			return fmt.Errorf("guard query failed: %s", err)
+		}
+		if !pass {
+			log.Debugf("guard query of metric: %s did not pass, skipping it", metricDefinition.Context)
+			return nil
+		}
+	}
+	if metricDefinition.Dedicated {
+		c := env.copy()
+		c.dedicated = true
+		env = c
+	}
+	switch metricDefinition.ColumnCase {
+	case "", "lower":
+	case "preserve":
+		c := env.copy()
+		c.preserveCase = true
+		env = c
+	default:
+		return &ScrapeError{Context: metricDefinition.Context, Step: scrapeStepConfig, Err: fmt.Errorf("unknown column case: %s", metricDefinition.ColumnCase)}
+	}
+	if *queryLabel != "off" {
+		env = withQueryLabel(env, metricDefinition.Request)
+	}
+	if metricDefinition.Rate {
+		rateCh := make(chan prometheus.Metric)
+		done := make(chan struct{})
+		go func() {
+			sendRates(env, rateCh, ch)
+			close(done)
+		}()
+		err := scrapeValues(env, rateCh, metricDefinition)
+		close(rateCh)
+		<-done
+		return err
+	}
+	return scrapeValues(env, ch, metricDefinition)
 }
 
-const oracleDate = "2006/01/02:15:04:05"
+// scrapeValues scrapes metricDefinition with the method matching its shape.
+func scrapeValues(env *dbEnvironment, ch chan<- prometheus.Metric, metricDefinition *Metric) error {
+	if metricDefinition.Name != "" {
+		return ScrapeScalar(env, ch, metricDefinition)
+	}
+	if metricDefinition.KeyColumn != "" {
+		return ScrapeKeyValues(env, ch, metricDefinition)
+	}
+	if len(metricDefinition.ResultSets) > 0 {
+		return scrapeResultSets(env, ch, metricDefinition)
+	}
+	return ScrapeGenericValues(env, ch, metricDefinition)
+}
 
-// ScrapeGenericValues generic method for retrieving metrics.
-func ScrapeGenericValues(
-	env string,
-	db *sql.DB,
-	ch chan<- prometheus.Metric,
-	context string,
-	labels []string,
-	metricsDesc map[string]string,
-	metricsType map[string]string,
-	fieldToAppend string,
-	ignoreZeroResult bool,
-	request string,
-) error {
-	log.Debugln("scrape generic values")
-	var metricsCount int
-	genericParser := func(row map[string]string) error {
-		// Construct labels value
-		labelsValues := []string{}
-		for _, label := range labels[:len(labels)-1] {
-			labelsValues = append(labelsValues, row[label])
+// queryLabelLength is the length the query text is truncated to in the
+// debug query label.
+const queryLabelLength = 64
+
+// withQueryLabel returns a copy of env whose metrics carry the text of query,
+// or its hash, in the exporter_query label.
+func withQueryLabel(env *dbEnvironment, query string) *dbEnvironment {
+	query = strings.Join(strings.Fields(query), " ")
+	switch *queryLabel {
+	case "hash":
+		query = hashLabelValue(query)
+	case "truncated":
+		if len(query) > queryLabelLength {
+			query = query[:queryLabelLength]
 		}
-		// adding env as the last label
-		labelsValues = append(labelsValues, env)
-		// Construct Prometheus values to sent back
-		for metric, metricHelp := range metricsDesc {
-			value, err := strconv.ParseFloat(strings.TrimSpace(row[metric]), 64)
-			// If not a float, skip current metric
-			if err != nil {
-				// check if it is an oracle date string
-				// 2020/01/23:16:00:03 using timezone of the box
-				t, err := time.Parse(oracleDate, strings.TrimSpace(row[metric]))
-				if err != nil {
-					continue
-				}
-				value = float64(t.Unix())
-			}
-			// If metric do not use a field content in metric's name
-			if strings.Compare(fieldToAppend, "") == 0 {
-				desc := prometheus.NewDesc(
-					prometheus.BuildFQName(namespace, context, metric),
-					metricHelp,
-					labels, nil,
-				)
-				log.Debugf("adding generic metric: %s", desc)
-				ch <- prometheus.MustNewConstMetric(desc, GetMetricType(metric, metricsType), value, labelsValues...)
+	}
+	labels := prometheus.Labels{"exporter_query": query}
+	for name, value := range env.labels {
+		labels[name] = value
+	}
+	c := env.copy()
+	c.labels = labels
+	return c
+}
+
+// checkGuard runs the guard query of a metric. The guard passes when its first
+// column holds a non zero number or a true value (TRUE, Y or YES).
+func checkGuard(env *dbEnvironment, query string) (bool, error) {
+	var pass, seen bool
+	parser := func(row map[string]string) error {
+		if seen {
+			return nil
+		}
+		seen = true
+		if len(row) != 1 {
+			return fmt.Errorf("guard query must return exactly one column, got %d", len(row))
+		}
+		for _, value := range row {
+			value = strings.ToUpper(strings.TrimSpace(value))
+			if number, err := strconv.ParseFloat(value, 64); err == nil {
+				pass = number != 0
 			} else {
-				desc := prometheus.NewDesc(
-					prometheus.BuildFQName(namespace, context, cleanName(row[fieldToAppend])),
-					metricHelp,
-					labels, nil,
-				)
-				log.Debugf("adding generic metric: %s", desc)
-				ch <- prometheus.MustNewConstMetric(desc, GetMetricType(metric, metricsType), value, labelsValues...)
+				pass = value == "TRUE" || value == "Y" || value == "YES"
 			}
-			metricsCount++
 		}
 		return nil
 	}
-	err := GeneratePrometheusMetrics(db, genericParser, request)
-	if err != nil {
-		return err
+	if err := GeneratePrometheusMetrics(env, parser, query); err != nil {
+		return false, err
 	}
-	if !ignoreZeroResult && metricsCount == 0 {
-		return errors.New("no metrics found while parsing")
-	}
-	return err
+	return pass, nil
 }
 
-// GeneratePrometheusMetrics inspired by https://kylewbanks.com/blog/query-result-to-map-in-golang
-// Parse SQL result and call parsing function to each row
-func GeneratePrometheusMetrics(db *sql.DB, parse func(row map[string]string) error, query string) error {
-
-	// Add a timeout
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(*queryTimeout)*time.Second)
-	defer cancel()
-	rows, err := db.QueryContext(ctx, query)
+// ScrapeScalar exports the single value returned by the request of a scalar
+// metric under the metric's own name.
+func ScrapeScalar(env *dbEnvironment, ch chan<- prometheus.Metric, metricDefinition *Metric) error {
+	var values []string
+	parser := func(row map[string]string) error {
+		if len(row) != 1 {
+			return fmt.Errorf("scalar metric: %s must return exactly one column, got %d", metricDefinition.Name, len(row))
+		}
+		for _, value := range row {
+			values = append(values, value)
+		}
+		return nil
+	}
+	if err := GeneratePrometheusMetrics(env, parser, metricDefinition.Request); err != nil {
+		return err
+	}
+	if len(values) != 1 {
+		return fmt.Errorf("scalar metric: %s must return exactly one row, got %d", metricDefinition.Name, len(values))
+	}
+	value, err := parseNumber(values[0], metricDefinition.groupSeparators())
+	if err != nil {
+		return fmt.Errorf("scalar metric: %s returned a non numeric value: %s", metricDefinition.Name, values[0])
+	}
 
-	if ctx.Err() == context.DeadlineExceeded {
-		return errors.New("oracle query timed out")
+	var valueType prometheus.ValueType
+	switch strings.ToLower(metricDefinition.Type) {
+	case "", "gauge":
+		valueType = prometheus.GaugeValue
+	case "counter":
+		valueType = prometheus.CounterValue
+	default:
+		return fmt.Errorf("unknown type: %s for scalar metric: %s", metricDefinition.Type, metricDefinition.Name)
 	}
 
+	var labelsValues []string
+	if !*disableSIDLabel {
+		labelsValues = append(labelsValues, env.sidLabel())
+	}
+	desc, err := newDesc(env.metricName(metricDefinition.Name), metricDefinition.Help, metricDefinition.Labels, env.labels)
 	if err != nil {
 		return err
 	}
-	cols, err := rows.Columns()
-	defer rows.Close()
+	ch <- prometheus.MustNewConstMetric(desc, valueType, value, labelsValues...)
+	return nil
+}
 
-	for rows.Next() {
-		// Create a slice of interface{}'s to represent each column,
-		// and a second slice to contain pointers to each item in the columns slice.
-		columns := make([]interface{}, len(cols))
-		columnPointers := make([]interface{}, len(cols))
-		for i := range columns {
-			columnPointers[i] = &columns[i]
+// ScrapeKeyValues exports one metric per row of a name/value shaped result.
+// The metric name is built from the key column, prefixed with prefix or with
+// the namespace and the context.
+func ScrapeKeyValues(env *dbEnvironment, ch chan<- prometheus.Metric, metricDefinition *Metric) error {
+	var valueType prometheus.ValueType
+	switch strings.ToLower(metricDefinition.Type) {
+	case "", "gauge":
+		valueType = prometheus.GaugeValue
+	case "counter":
+		valueType = prometheus.CounterValue
+	default:
+		return fmt.Errorf("unknown type: %s for metric: %s", metricDefinition.Type, metricDefinition.Context)
+	}
+
+	labels := metricDefinition.Labels
+	var metricsCount, skipped int
+	parser := func(row map[string]string) error {
+		key := row[env.columnName(metricDefinition.KeyColumn)]
+		value, err := parseNumber(row[env.columnName(metricDefinition.ValueColumn)], metricDefinition.groupSeparators())
+		if err != nil {
+			log.Debugf("skipping non numeric value of: %s in metric: %s", key, metricDefinition.Context)
+			skipped++
+			return nil
 		}
 
-		// Scan the result into the column pointers...
-		if err := rows.Scan(columnPointers...); err != nil {
+		deriveLabels(env, row, metricDefinition.LabelValues)
+		if err := checkLabelColumns(env, row, labels, metricDefinition.Context); err != nil {
 			return err
 		}
+		labelsValues := rowLabelValues(row, labels, env.sidLabel(), metricDefinition.HashLabels)
 
-		// Create our map, and retrieve the value for each column from the pointers slice,
-		// storing it in the map with the name of the column as the key.
-		m := make(map[string]string)
-		for i, colName := range cols {
-			val := columnPointers[i].(*interface{})
-			m[strings.ToLower(colName)] = fmt.Sprintf("%v", *val)
+		name := prometheus.BuildFQName(namespace, metricDefinition.Context, cleanName(key))
+		if metricDefinition.Prefix != "" {
+			name = metricDefinition.Prefix + cleanName(key)
+		}
+		help := metricDefinition.Help
+		if help == "" {
+			help = fmt.Sprintf("Value of %s.", key)
+		}
+		desc, err := newDesc(env.metricName(name), help, labels, env.labels)
+		if err != nil {
+			return err
+		}
+		log.Debugf("adding key value metric: %s", desc)
+		ch <- prometheus.MustNewConstMetric(desc, valueType, value, labelsValues...)
+		metricsCount++
+		return nil
+	}
+	if err := GeneratePrometheusMetrics(env, parser, metricDefinition.Request); err != nil {
+		return err
+	}
+	scrapeParseErrors.WithLabelValues(metricDefinition.Context, strconv.Itoa(metricDefinition.index), env.sid).Set(float64(skipped))
+	if !metricDefinition.IgnoreZeroResult && metricsCount == 0 {
+		return &ScrapeError{Context: metricDefinition.Context, Step: scrapeStepEmpty, Err: errors.New("no metrics found while parsing")}
+	}
+	return nil
+}
+
+// rowLabelValues returns the values of labels in row, followed by the SID
+// unless the sid label is disabled. Values of the hashLabels columns are
+// replaced by a truncated SHA-1 hash.
+func rowLabelValues(row map[string]string, labels []string, sid string, hashLabels []string) []string {
+	labelsValues := []string{}
+	for _, label := range rowLabelNames(labels) {
+		value := row[label]
+		for _, hashLabel := range hashLabels {
+			if hashLabel == label {
+				value = hashLabelValue(value)
+				break
+			}
+		}
+		labelsValues = append(labelsValues, value)
+	}
+	// adding env as the last label
+	if !*disableSIDLabel {
+		labelsValues = append(labelsValues, sid)
+	}
+	return labelsValues
+}
+
+// rowLabelNames returns the labels whose values come from the rows, all but
+// the sid label.
+func rowLabelNames(labels []string) []string {
+	if !*disableSIDLabel {
+		return labels[:len(labels)-1]
+	}
+	return labels
+}
+
+// checkLabelColumns returns an error if a label of the metric context is
+// neither a column of row nor derived with labelvalues.
+func checkLabelColumns(env *dbEnvironment, row map[string]string, labels []string, context string) error {
+	for _, label := range rowLabelNames(labels) {
+		if _, ok := row[label]; !ok {
+			return fmt.Errorf("label: %s of metric: %s is not a column of the result, columns are %s", label, context, env.columnCaseHint())
+		}
+	}
+	return nil
+}
+
+// deriveLabels sets the labels of labelValues in row. Their values are
+// templates where ${column} is replaced by the value of the column, a value
+// without column is a constant.
+func deriveLabels(env *dbEnvironment, row map[string]string, labelValues map[string]string) {
+	for label, template := range labelValues {
+		row[label] = os.Expand(template, func(column string) string {
+			return row[env.columnName(column)]
+		})
+	}
+}
+
+// rowAllowed reports whether the label values of row are in the allowed
+// values of labelFilter.
+func rowAllowed(env *dbEnvironment, row map[string]string, labelFilter map[string][]string) bool {
+	for label, allowed := range labelFilter {
+		found := false
+		for _, value := range allowed {
+			if row[env.columnName(label)] == value {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// jsonValue returns the value found at the dot separated path of the JSON
+// document doc. Array elements are selected by their index.
+func jsonValue(doc string, path string) (string, error) {
+	var v interface{}
+	if err := json.Unmarshal([]byte(doc), &v); err != nil {
+		return "", err
+	}
+	for _, key := range strings.Split(path, ".") {
+		switch node := v.(type) {
+		case map[string]interface{}:
+			v = node[key]
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(node) {
+				return "", fmt.Errorf("invalid index: %s in JSON path: %s", key, path)
+			}
+			v = node[i]
+		default:
+			return "", fmt.Errorf("JSON path: %s not found", path)
+		}
+	}
+	if v == nil {
+		return "", fmt.Errorf("JSON path: %s not found", path)
+	}
+	return fmt.Sprintf("%v", v), nil
+}
+
+// hashLabelValue hides a sensitive label value while keeping it usable for
+// grouping.
+func hashLabelValue(value string) string {
+	sum := sha1.Sum([]byte(value))
+	return hex.EncodeToString(sum[:8])
+}
+
+const oracleDate = "2006/01/02:15:04:05"
+
+// timestampLayouts are the layouts of the dates and timestamps converted to
+// unix timestamps. Timestamps with a time zone are accepted as printed by the
+// driver, with TO_CHAR(ts, 'YYYY-MM-DD HH24:MI:SS.FF TZH:TZM') or with the
+// default NLS_TIMESTAMP_TZ_FORMAT, and their offset is honored. Fractional
+// seconds may follow the seconds of any layout.
+var timestampLayouts = []string{
+	oracleDate,
+	"2006-01-02 15:04:05 -07:00",
+	"2006-01-02 15:04:05 -0700 MST",
+	"2006-01-02 15:04:05 -0700 -0700",
+	"02-Jan-06 03.04.05 PM -07:00",
+	time.RFC3339Nano,
+}
+
+// Layouts of the timestamps followed by a time zone region, like
+// Europe/Zurich.
+var timestampRegionLayouts = []string{
+	"2006-01-02 15:04:05",
+	"02-Jan-06 03.04.05 PM",
+}
+
+// parseNumber parses value as a float after removing the characters of
+// separators, the group separators of formatted numbers.
+func parseNumber(value string, separators string) (float64, error) {
+	return strconv.ParseFloat(stripSeparators(strings.TrimSpace(value), separators), 64)
+}
+
+// stripSeparators removes the characters of separators from value.
+func stripSeparators(value string, separators string) string {
+	if separators == "" {
+		return value
+	}
+	return strings.Map(func(r rune) rune {
+		if strings.ContainsRune(separators, r) {
+			return -1
+		}
+		return r
+	}, value)
+}
+
+// parseTimestamp parses value with the first matching timestamp layout.
+func parseTimestamp(value string) (time.Time, error) {
+	var err error
+	for _, layout := range timestampLayouts {
+		var t time.Time
+		if t, err = time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	if i := strings.LastIndex(value, " "); i > 0 {
+		if loc, locErr := time.LoadLocation(value[i+1:]); locErr == nil {
+			for _, layout := range timestampRegionLayouts {
+				if t, regionErr := time.ParseInLocation(layout, value[:i], loc); regionErr == nil {
+					return t, nil
+				}
+			}
+		}
+	}
+	return time.Time{}, err
+}
+
+// Factors converting the supported time units to seconds.
+var timeUnits = map[string]float64{
+	"":   1,
+	"s":  1,
+	"cs": 1e-2,
+	"ms": 1e-3,
+	"us": 1e-6,
+}
+
+// Integers above maxExactFloat can't all be represented by a float64, the
+// type of Prometheus sample values.
+const maxExactFloat = 1 << 53
+
+// queryTimeoutError is returned when a query exceeds its timeout. context is
+// set once the metric running the query is known.
+type queryTimeoutError struct {
+	context string
+	timeout time.Duration
+	elapsed time.Duration
+}
+
+func (err *queryTimeoutError) Error() string {
+	if err.context == "" {
+		return fmt.Sprintf("oracle query timed out after %s, the timeout is %s", err.elapsed.Round(time.Millisecond), err.timeout)
+	}
+	return fmt.Sprintf("oracle query of metric: %s timed out after %s, the timeout is %s", err.context, err.elapsed.Round(time.Millisecond), err.timeout)
+}
+
+// Steps of ScrapeGenericValues a ScrapeError can occur in.
+const (
+	scrapeStepConfig = "config"
+	scrapeStepQuery  = "query"
+	scrapeStepLabels = "labels"
+	scrapeStepParse  = "parse"
+	scrapeStepEmpty  = "empty"
+)
+
+// ScrapeError is returned by ScrapeGenericValues, it tells which step of the
+// scrape of a metric context failed. Metric is the value column being
+// exported, it is empty when the failure isn't tied to a column.
+type ScrapeError struct {
+	Context string
+	Metric  string
+	Step    string
+	Err     error
+}
+
+func (err *ScrapeError) Error() string {
+	if err.Metric == "" {
+		return fmt.Sprintf("%s step of metric: %s failed with: %s", err.Step, err.Context, err.Err)
+	}
+	return fmt.Sprintf("%s step of value: %s of metric: %s failed with: %s", err.Step, err.Metric, err.Context, err.Err)
+}
+
+// Unwrap returns the cause of err.
+func (err *ScrapeError) Unwrap() error {
+	return err.Err
+}
+
+// isEmptyResult reports whether err only tells that the query of a metric
+// returned no values.
+func isEmptyResult(err error) bool {
+	var scrapeErr *ScrapeError
+	return errors.As(err, &scrapeErr) && scrapeErr.Step == scrapeStepEmpty
+}
+
+// queryTimeouts counts the queries of each metric that exceeded their timeout.
+var queryTimeouts = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Subsystem: exporter,
+	Name:      "query_timeouts_total",
+	Help:      "Total number of queries of the metric that exceeded their timeout.",
+}, []string{"collector", "sid"})
+
+// ScrapeGenericValues generic method for retrieving metrics.
+func ScrapeGenericValues(env *dbEnvironment, ch chan<- prometheus.Metric, metricDefinition *Metric) error {
+	return scrapeGenericValues(env, ch, metricDefinition,
+		func(parse func(row map[string]string) error) error {
+			return GeneratePrometheusMetrics(env, parse, metricDefinition.Request)
+		})
+}
+
+// scrapeGenericValues exports the rows that generate passes to parse, like
+// ScrapeGenericValues does for the rows of a request.
+func scrapeGenericValues(
+	env *dbEnvironment,
+	ch chan<- prometheus.Metric,
+	metricDefinition *Metric,
+	generate func(parse func(row map[string]string) error) error,
+) error {
+	log.Debugln("scrape generic values")
+	scale, ok := timeUnits[strings.ToLower(metricDefinition.TimeUnit)]
+	if !ok {
+		return &ScrapeError{Context: metricDefinition.Context, Step: scrapeStepConfig, Err: fmt.Errorf("unknown time unit: %s", metricDefinition.TimeUnit)}
+	}
+	switch metricDefinition.OnParseError {
+	case "", "skip", "zero", "error":
+	default:
+		return &ScrapeError{Context: metricDefinition.Context, Step: scrapeStepConfig, Err: fmt.Errorf("unknown parse error mode: %s", metricDefinition.OnParseError)}
+	}
+	for column, valueType := range metricDefinition.ValueTypes {
+		if !knownValueTypes[valueType] {
+			return &ScrapeError{Context: metricDefinition.Context, Metric: column, Step: scrapeStepConfig, Err: fmt.Errorf("unknown value type: %s", valueType)}
+		}
+	}
+	separators := metricDefinition.groupSeparators()
+	var metricsCount int
+	var skipped, parseErrors int
+	var truncated bool
+	var rowsCount int
+	genericParser := func(row map[string]string) error {
+		deriveLabels(env, row, metricDefinition.LabelValues)
+		// Drop the rows whose labels aren't allowed
+		if !rowAllowed(env, row, metricDefinition.LabelFilter) {
+			return nil
+		}
+		rowsCount++
+		// Only keep the first row of singleton metrics
+		if metricDefinition.SingleRow && rowsCount > 1 {
+			return nil
+		}
+		// Only keep the first rows of top N metrics
+		if metricDefinition.MaxRows > 0 && rowsCount > metricDefinition.MaxRows {
+			return nil
+		}
+		// Keep the original value of the field appended to the name
+		if metricDefinition.FieldLabel != "" {
+			row[metricDefinition.FieldLabel] = row[metricDefinition.FieldToAppend]
+		}
+		if err := checkLabelColumns(env, row, metricDefinition.Labels, metricDefinition.Context); err != nil {
+			return &ScrapeError{Context: metricDefinition.Context, Step: scrapeStepLabels, Err: err}
+		}
+		// Construct labels value
+		labelsValues := rowLabelValues(row, metricDefinition.Labels, env.sidLabel(), metricDefinition.HashLabels)
+		// Construct Prometheus values to sent back
+		for metric, metricHelp := range metricDefinition.MetricsDesc {
+			if metricDefinition.MaxSeries > 0 && metricsCount >= metricDefinition.MaxSeries {
+				truncated = true
+				break
+			}
+			raw := row[metric]
+			// Extract the value from a JSON document
+			if path, ok := metricDefinition.JSONPaths[metric]; ok {
+				var err error
+				if raw, err = jsonValue(raw, path); err != nil {
+					log.Debugf("skipping metric: %s of: %s with: %s", metric, metricDefinition.Context, err)
+					skipped++
+					continue
+				}
+			}
+			// Numbers are normalized to seconds, dates are not
+			value, err := parseValue(raw, metricDefinition.ValueTypes[metric], separators, scale)
+			if err != nil {
+				if metricDefinition.OnParseError == "zero" {
+					log.Debugf("value: %s of metric: %s of: %s is %s, it is exported as 0", strings.TrimSpace(raw), metric, metricDefinition.Context, err)
+					value = 0
+				} else {
+					if metricDefinition.OnParseError == "error" {
+						parseErrors++
+					}
+					skipped++
+					log.Debugf("skipping value: %s of metric: %s of: %s, it is %s", strings.TrimSpace(raw), metric, metricDefinition.Context, err)
+					continue
+				}
+			} else if math.Abs(value) > maxExactFloat {
+				log.Debugf("value: %s of metric: %s of: %s exceeds the float64 precision, it is exported as %g", strings.TrimSpace(raw), metric, metricDefinition.Context, value)
+			}
+			// If metric do not use a field content in metric's name
+			if strings.Compare(metricDefinition.FieldToAppend, "") == 0 {
+				desc, err := newDesc(
+					env.metricName(prometheus.BuildFQName(namespace, metricDefinition.Context, metric)),
+					metricHelp,
+					metricDefinition.Labels, env.labels,
+				)
+				if err != nil {
+					return &ScrapeError{Context: metricDefinition.Context, Metric: metric, Step: scrapeStepLabels, Err: err}
+				}
+				log.Debugf("adding generic metric: %s", desc)
+				ch <- prometheus.MustNewConstMetric(desc, GetMetricType(metric, metricDefinition.MetricsType), value, labelsValues...)
+			} else {
+				desc, err := newDesc(
+					env.metricName(prometheus.BuildFQName(namespace, metricDefinition.Context, cleanName(row[metricDefinition.FieldToAppend]))),
+					metricHelp,
+					metricDefinition.Labels, env.labels,
+				)
+				if err != nil {
+					return &ScrapeError{Context: metricDefinition.Context, Metric: metric, Step: scrapeStepLabels, Err: err}
+				}
+				log.Debugf("adding generic metric: %s", desc)
+				ch <- prometheus.MustNewConstMetric(desc, GetMetricType(metric, metricDefinition.MetricsType), value, labelsValues...)
+			}
+			metricsCount++
+		}
+		return nil
+	}
+	err := generate(genericParser)
+	if err != nil {
+		if _, ok := err.(*ScrapeError); ok {
+			return err
+		}
+		return &ScrapeError{Context: metricDefinition.Context, Step: scrapeStepQuery, Err: err}
+	}
+	scrapeParseErrors.WithLabelValues(metricDefinition.Context, strconv.Itoa(metricDefinition.index), env.sid).Set(float64(skipped))
+	if metricDefinition.SingleRow && rowsCount > 1 {
+		log.Warnf("metric: %s returned %d rows, only the first one was used", metricDefinition.Context, rowsCount)
+	}
+	if truncated {
+		log.Warnf("metric: %s reached its limit of %d series, remaining rows were dropped", metricDefinition.Context, metricDefinition.MaxSeries)
+	}
+	if parseErrors > 0 {
+		return &ScrapeError{Context: metricDefinition.Context, Step: scrapeStepParse, Err: fmt.Errorf("%d values could not be parsed", parseErrors)}
+	}
+	if !metricDefinition.IgnoreZeroResult && metricsCount == 0 {
+		return &ScrapeError{Context: metricDefinition.Context, Step: scrapeStepEmpty, Err: errors.New("no metrics found while parsing")}
+	}
+	return nil
+}
+
+// scrapeResultSets exports the result sets of metricDefinition. Its request
+// returns a single row whose columns are cursors, like the ref cursors of a
+// PL/SQL function, each exported as the result set of the column name, so that
+// one round trip feeds several metrics.
+func scrapeResultSets(env *dbEnvironment, ch chan<- prometheus.Metric, metricDefinition *Metric) error {
+	return runQuery(env, metricDefinition.Request, func(ctx context.Context, rows *sql.Rows, timeoutErr func() error) error {
+		cols, err := rows.Columns()
+		if err != nil {
+			return err
+		}
+		if !rows.Next() {
+			if err := rows.Err(); err != nil {
+				return err
+			}
+			return errors.New("no result sets returned")
+		}
+		cursors := make([]*sql.Rows, len(cols))
+		dest := make([]interface{}, len(cols))
+		for i := range cursors {
+			cursors[i] = new(sql.Rows)
+			dest[i] = cursors[i]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return fmt.Errorf("result sets must be cursors: %s", err)
+		}
+		// Release the cursors on every path, the loop below closes them as
+		// soon as they were read.
+		for _, cursor := range cursors {
+			defer cursor.Close()
+		}
+		var failed []string
+		for i, col := range cols {
+			set, ok := metricDefinition.ResultSets[env.columnName(col)]
+			if !ok {
+				log.Debugf("ignoring result set: %s of metric: %s, it has no definition", col, metricDefinition.Context)
+				cursors[i].Close()
+				continue
+			}
+			err := scrapeGenericValues(env, ch, set,
+				func(parse func(row map[string]string) error) error {
+					return parseRows(ctx, env, cursors[i], parse, timeoutErr)
+				})
+			cursors[i].Close()
+			if err != nil {
+				log.Errorln("error scraping result set for", set.Context, ":", err)
+				failed = append(failed, set.Context)
+			}
+		}
+		if len(failed) > 0 {
+			return fmt.Errorf("failed to scrape result sets: %s", strings.Join(failed, ", "))
+		}
+		return nil
+	})
+}
+
+// GeneratePrometheusMetrics inspired by https://kylewbanks.com/blog/query-result-to-map-in-golang
+// Parse SQL result and call parsing function to each row
+func GeneratePrometheusMetrics(env *dbEnvironment, parse func(row map[string]string) error, query string) error {
+	return runQuery(env, query, func(ctx context.Context, rows *sql.Rows, timeoutErr func() error) error {
+		return parseRows(ctx, env, rows, parse, timeoutErr)
+	})
+}
+
+// runQuery runs query on the database of env and passes its rows to read.
+// ctx is the context of the query and timeoutErr returns the error to report
+// once ctx exceeded its deadline.
+func runQuery(env *dbEnvironment, query string, read func(ctx context.Context, rows *sql.Rows, timeoutErr func() error) error) error {
+	// Bound the wait for the connection, the pool only holds one.
+	acquireCtx, acquireCancel := context.WithTimeout(context.Background(), time.Duration(*acquireTimeout)*time.Second)
+	start := time.Now()
+	db, release := env.database()
+	defer release()
+	conn, err := db.Conn(acquireCtx)
+	acquireCancel()
+	connWait.WithLabelValues(env.sid).Observe(time.Since(start).Seconds())
+	if err != nil {
+		return fmt.Errorf("unable to acquire a database connection: %s", err)
+	}
+	defer conn.Close()
+
+	// Add a timeout. While the statement is executing, oci8 calls OCIBreak
+	// on the session once the context is done so the server stops the query.
+	ctx, cancel := context.WithTimeout(context.Background(), env.timeout())
+	defer cancel()
+	queryStart := time.Now()
+	timeoutErr := func() error {
+		return &queryTimeoutError{timeout: env.timeout(), elapsed: time.Since(queryStart)}
+	}
+	rows, err := conn.QueryContext(ctx, query)
+
+	if ctx.Err() == context.DeadlineExceeded {
+		return timeoutErr()
+	}
+
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	return read(ctx, rows, timeoutErr)
+}
+
+// columnName returns the name the metrics definitions use for the column
+// col of a result. Oracle reports unquoted aliases in upper case, so the
+// names are lower cased unless the metric sets columncase to preserve, in
+// which case its definition must spell them as the database reports them.
+func (env *dbEnvironment) columnName(col string) string {
+	if env.preserveCase {
+		return col
+	}
+	return strings.ToLower(col)
+}
+
+// columnCaseHint describes the case of the column names in errors.
+func (env *dbEnvironment) columnCaseHint() string {
+	if env.preserveCase {
+		return "in the case reported by the database"
+	}
+	return "lower case"
+}
+
+// parseRows calls parse with each row of rows, mapping the column names, see
+// columnName, to the values.
+func parseRows(ctx context.Context, env *dbEnvironment, rows *sql.Rows, parse func(row map[string]string) error, timeoutErr func() error) error {
+	cols, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+
+	var rowsCount int
+	for rows.Next() {
+		if *queryMaxRows > 0 && rowsCount >= *queryMaxRows {
+			log.Warnf("query on SID: %s returned more than %d rows, remaining rows were ignored", env.sid, *queryMaxRows)
+			break
+		}
+		rowsCount++
+
+		// Fetches are not interrupted by oci8, stop reading rows once the
+		// deadline passed. Closing the rows releases the cursor on the server.
+		if ctx.Err() == context.DeadlineExceeded {
+			return timeoutErr()
+		}
+
+		// Create a slice of interface{}'s to represent each column,
+		// and a second slice to contain pointers to each item in the columns slice.
+		columns := make([]interface{}, len(cols))
+		columnPointers := make([]interface{}, len(cols))
+		for i := range columns {
+			columnPointers[i] = &columns[i]
+		}
+
+		// Scan the result into the column pointers...
+		if err := rows.Scan(columnPointers...); err != nil {
+			return err
+		}
+
+		// Create our map, and retrieve the value for each column from the pointers slice,
+		// storing it in the map with the name of the column as the key.
+		m := make(map[string]string)
+		for i, colName := range cols {
+			val := columnPointers[i].(*interface{})
+			m[env.columnName(colName)] = fmt.Sprintf("%v", *val)
 		}
 		// Call function to parse row
 		if err := parse(m); err != nil {
@@ -362,7 +1702,381 @@ func GeneratePrometheusMetrics(db *sql.DB, parse func(row map[string]string) err
 		}
 	}
 
-	return nil
+	// database/sql closes the rows when the context is done, which would
+	// otherwise look like a complete result set.
+	if ctx.Err() == context.DeadlineExceeded {
+		return timeoutErr()
+	}
+	return rows.Err()
+}
+
+// defaultMetrics are the metrics of the default metrics file as decoded. They
+// are kept so that a reload doesn't need to read the file again.
+var defaultMetrics []*Metric
+
+// loadMetrics reads the custom metric files, and the default one if
+// readDefaults is set or it wasn't read yet, and returns the metrics to scrape.
+func loadMetrics(readDefaults bool) ([]*Metric, error) {
+	// Load default metrics
+	if readDefaults || defaultMetrics == nil {
+		var defaults struct{ Metric []*Metric }
+		if _, err := toml.DecodeFile(*defaultFileMetrics, &defaults); err != nil {
+			return nil, fmt.Errorf("failed loading default metrics: %s with: %s", *defaultFileMetrics, err)
+		}
+		defaultMetrics = defaults.Metric
+	}
+	// The metrics are completed below and when they are scraped, so work on
+	// copies of the decoded ones.
+	var metrics struct{ Metric []*Metric }
+	for _, metric := range defaultMetrics {
+		metrics.Metric = append(metrics.Metric, metric.copy())
+	}
+
+	// If custom metrics, load them. A broken file is skipped so that the
+	// others are still scraped, its status is exported.
+	var custom []*Metric
+	for _, file := range strings.Split(*customMetrics, ",") {
+		if file = strings.TrimSpace(file); file == "" {
+			continue
+		}
+		var addMetrics struct{ Metric []*Metric }
+		data, err := readMetricsFile(file)
+		if err == nil {
+			_, err = toml.Decode(string(data), &addMetrics)
+		}
+		if err != nil {
+			log.Errorf("failed loading custom metrics: %s with: %s", file, err)
+			setCustomFileStatus(file, customFileFailed)
+			continue
+		}
+		setCustomFileStatus(file, customFileLoaded)
+		custom = append(custom, addMetrics.Metric...)
+	}
+	if *diagnosticsPack {
+		ash, err := ashMetric(*ashWindow)
+		if err != nil {
+			return nil, err
+		}
+		metrics.Metric = append(metrics.Metric, ash)
+	}
+	if *heartbeatTable != "" {
+		goldenGate, err := goldenGateMetric(*heartbeatTable)
+		if err != nil {
+			return nil, err
+		}
+		metrics.Metric = append(metrics.Metric, goldenGate)
+	}
+	if *overrideMetrics {
+		metrics.Metric = overrideDefaults(metrics.Metric, custom)
+	}
+	metrics.Metric = append(metrics.Metric, custom...)
+	for _, metric := range metrics.Metric {
+		// Scalar metrics are identified by their name
+		if metric.Name != "" && metric.Context == "" {
+			metric.Context = metric.Name
+		}
+		if metric.Name == "" {
+			addColumnLabels(metric)
+		}
+		// Translate the container ID of the rows to a pdb label
+		if metric.PDBLabel && metric.Name == "" {
+			metric.Labels = append(metric.Labels, "pdb")
+			metric.Request = withPDBName(metric.Request)
+		}
+		// Result sets are named after their column by default
+		for column, set := range metric.ResultSets {
+			if set.Context == "" {
+				set.Context = column
+			}
+			addColumnLabels(set)
+		}
+	}
+	renameMetrics(metrics.Metric, *metricRenames)
+	indexMetrics(metrics.Metric)
+	var valid []*Metric
+	for _, metric := range metrics.Metric {
+		if err := checkMetric(metric); err != nil {
+			log.Errorf("skipping metric: %s with: %s", metric.Context, err)
+			continue
+		}
+		valid = append(valid, metric)
+	}
+	return filterMetrics(valid, *enableCollectors, *disableCollectors), nil
+}
+
+// checkMetric returns an error if metric can't be exported as defined.
+func checkMetric(metric *Metric) error {
+	if metric.Name != "" {
+		if !model.IsValidMetricName(model.LabelValue(metric.Name)) {
+			return fmt.Errorf("invalid metric name: %s", metric.Name)
+		}
+		// The query of a scalar metric returns a single value
+		if len(metric.Labels) > 0 {
+			return fmt.Errorf("scalar metric: %s can't have labels", metric.Name)
+		}
+	}
+	if metric.KeyColumn != "" && metric.Prefix != "" && !model.IsValidMetricName(model.LabelValue(metric.Prefix)) {
+		return fmt.Errorf("invalid metric name prefix: %s", metric.Prefix)
+	}
+	return nil
+}
+
+// groupSeparators returns the characters stripped from the values of metric
+// before they are parsed as numbers.
+func (metric *Metric) groupSeparators() string {
+	if metric.GroupSeparators != "" {
+		return metric.GroupSeparators
+	}
+	return *numberSeparators
+}
+
+// addColumnLabels adds the labels taken from the columns of metric to its
+// labels.
+func addColumnLabels(metric *Metric) {
+	// The original value of the field appended to the name is a label
+	if metric.FieldLabel != "" && metric.FieldToAppend != "" {
+		metric.Labels = append(metric.Labels, metric.FieldLabel)
+	}
+	// Labels derived from the columns or constant
+	var derived []string
+	for label := range metric.LabelValues {
+		derived = append(derived, label)
+	}
+	sort.Strings(derived)
+	metric.Labels = append(metric.Labels, derived...)
+}
+
+// copy returns a copy of metric whose labels and result sets can be
+// completed without changing metric.
+func (metric *Metric) copy() *Metric {
+	m := *metric
+	m.Labels = append([]string(nil), metric.Labels...)
+	if metric.ResultSets != nil {
+		m.ResultSets = make(map[string]*Metric)
+		for column, set := range metric.ResultSets {
+			m.ResultSets[column] = set.copy()
+		}
+	}
+	return &m
+}
+
+// overrideDefaults returns the default metrics without the ones whose
+// context is redefined by a custom metric.
+func overrideDefaults(defaults []*Metric, custom []*Metric) []*Metric {
+	contexts := make(map[string]bool)
+	for _, metric := range custom {
+		contexts[metric.Context] = true
+	}
+	var kept []*Metric
+	for _, metric := range defaults {
+		if contexts[metric.Context] {
+			log.Infof("default metric: %s is replaced by a custom metric", metric.Context)
+			continue
+		}
+		kept = append(kept, metric)
+	}
+	return kept
+}
+
+// withPDBName wraps request to add a pdb column holding the name of the
+// container of the con_id column. Rows without a matching container, like
+// con_id 0 for the whole CDB, keep their ID.
+func withPDBName(request string) string {
+	return "SELECT r.*, NVL(c.name, TO_CHAR(r.con_id)) as pdb FROM (" +
+		strings.TrimRight(strings.TrimSpace(request), ";") +
+		") r LEFT JOIN v$containers c ON c.con_id = r.con_id"
+}
+
+// Load statuses of a custom metrics file.
+const (
+	customFileLoaded = "loaded"
+	customFileFailed = "failed"
+)
+
+// customFileStatus tracks whether each custom metrics file could be parsed.
+var customFileStatus = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Subsystem: exporter,
+	Name:      "custom_metrics_file",
+	Help:      "Load status of a custom metrics file (1 for the current status, 0 otherwise).",
+}, []string{"file", "status"})
+
+func setCustomFileStatus(file string, status string) {
+	for _, s := range []string{customFileLoaded, customFileFailed} {
+		value := 0.0
+		if s == status {
+			value = 1
+		}
+		customFileStatus.WithLabelValues(file, s).Set(value)
+	}
+}
+
+// metricsLoaded and configHash describe the loaded metric definitions, so that
+// the configuration of a fleet of exporters can be compared.
+var (
+	metricsLoaded = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: exporter,
+		Name:      "metrics_loaded",
+		Help:      "Number of metric definitions loaded.",
+	})
+	configHash = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: exporter,
+		Name:      "config_hash",
+		Help:      "Hash of the loaded metric definitions.",
+	})
+)
+
+// setConfigMetrics exports the number and the hash of the loaded metrics. The
+// hash is the FNV-1a of their JSON definitions, 32 bits so that it is exactly
+// represented by a sample value.
+func setConfigMetrics(metrics []*Metric) {
+	h := fnv.New32a()
+	if err := json.NewEncoder(h).Encode(metrics); err != nil {
+		log.Errorf("failed to hash metric definitions with: %s", err)
+		return
+	}
+	metricsLoaded.Set(float64(len(metrics)))
+	configHash.Set(float64(h.Sum32()))
+}
+
+// filterMetrics returns the metrics to scrape, skipping the disabled ones
+// unless they are explicitly enabled.
+func filterMetrics(metrics []*Metric, enable string, disable string) []*Metric {
+	contexts := func(s string) map[string]bool {
+		m := make(map[string]bool)
+		for _, c := range strings.Split(s, ",") {
+			if c = strings.TrimSpace(c); c != "" {
+				m[c] = true
+			}
+		}
+		return m
+	}
+	enabled, disabled := contexts(enable), contexts(disable)
+
+	var filtered []*Metric
+	for _, metric := range metrics {
+		if disabled[metric.Context] || (metric.Disabled && !enabled[metric.Context]) {
+			log.Infof("metric: %s is disabled", metric.Context)
+			continue
+		}
+		filtered = append(filtered, metric)
+	}
+	return filtered
+}
+
+// configHandler returns the definitions of the metrics scraped on each
+// metrics path as JSON, keyed by path.
+func configHandler(exporters map[string]*Exporter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		definitions := make(map[string][]*Metric, len(exporters))
+		for path, e := range exporters {
+			e.mtx.RLock()
+			definitions[path] = e.metricsToScrap
+			e.mtx.RUnlock()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(definitions); err != nil {
+			log.Errorf("failed to encode metric definitions: %s", err)
+		}
+	}
+}
+
+// writeTextfile scrapes e once and writes the metrics to path in the text
+// format read by the node_exporter textfile collector. The file is replaced
+// atomically so that it is never read half written.
+func writeTextfile(e *Exporter, path string) error {
+	registry := prometheus.NewRegistry()
+	if err := registry.Register(onceCollector{e}); err != nil {
+		return err
+	}
+	families, err := registry.Gather()
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	for _, family := range families {
+		if _, err := expfmt.MetricFamilyToText(tmp, family); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// strictHandler wraps the metrics handler to answer with HTTP 500 when none
+// of the databases could be scraped. The metrics are still sent in the body.
+func strictHandler(e *Exporter, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(&strictResponseWriter{ResponseWriter: w, exporter: e}, r)
+	})
+}
+
+// strictResponseWriter replaces the 200 status code once the metrics are
+// gathered, which happens before anything is written.
+type strictResponseWriter struct {
+	http.ResponseWriter
+	exporter    *Exporter
+	wroteHeader bool
+}
+
+func (w *strictResponseWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	if code == http.StatusOK && w.exporter.allDown() {
+		code = http.StatusInternalServerError
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *strictResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// indexMetrics numbers the definitions, result sets included, that share a
+// context so that their per metric series don't overwrite each other.
+func indexMetrics(metrics []*Metric) {
+	count := make(map[string]int)
+	for _, metric := range metrics {
+		metric.index = count[metric.Context]
+		count[metric.Context]++
+		columns := make([]string, 0, len(metric.ResultSets))
+		for column := range metric.ResultSets {
+			columns = append(columns, column)
+		}
+		sort.Strings(columns)
+		for _, column := range columns {
+			set := metric.ResultSets[column]
+			set.index = count[set.Context]
+			count[set.Context]++
+		}
+	}
+}
+
+// renameMetrics replaces the context of the metrics found in renames.
+func renameMetrics(metrics []*Metric, renames map[string]string) {
+	for _, metric := range metrics {
+		if newContext, ok := renames[metric.Context]; ok {
+			log.Infof("renaming metric context: %s to: %s", metric.Context, newContext)
+			metric.Context = newContext
+		}
+	}
 }
 
 // Oracle gives us some ugly names back. This function cleans things up for Prometheus.
@@ -372,13 +2086,179 @@ func cleanName(s string) string {
 	s = strings.Replace(s, ")", "", -1)  // Remove close parenthesis
 	s = strings.Replace(s, "/", "", -1)  // Remove forward slashes
 	s = strings.ToLower(s)
+	s = invalidNameChars.ReplaceAllString(s, "_") // Replace what Prometheus doesn't allow
+	if s != "" && s[0] >= '0' && s[0] <= '9' {
+		s = "_" + s // Names can't start with a digit
+	}
 	return s
 }
 
+var invalidNameChars = regexp.MustCompile(`[^a-zA-Z0-9_:]`)
+
 type dbEnvironment struct {
-	sid string
-	dsn string
-	db  *sql.DB
+	sid          string
+	dsn          string
+	labels       prometheus.Labels
+	queryTimeout time.Duration
+	leader       int32
+	// conns holds the connection pools of the database, opened with dsn
+	// until its credentials are rotated. Query it through database.
+	conns *connections
+	// dedicated selects the secondary pool of the metrics with dedicated
+	// set, so that slow queries don't hold the connection of the other
+	// metrics.
+	dedicated bool
+	// done is closed when the database is no longer scraped.
+	done chan struct{}
+	// credentials returns the current DSN from the secret backend, it is
+	// nil when the DSN is static.
+	credentials func() (string, error)
+	// prefix and suffix are added to the names of the scraped metrics, so
+	// that federated exporters fronting different databases don't collide.
+	prefix, suffix string
+	// maintenance are the windows during which the database isn't scraped.
+	maintenance []maintenanceWindow
+	// identity caches the result of the identity query, it is shared with
+	// the copies of the environment.
+	identity *identity
+	// preserveCase keeps the case of the column names reported by the
+	// database, for the metrics with columncase set to preserve.
+	preserveCase bool
+}
+
+// metricName returns the name of the scraped metric fqName for env.
+func (env *dbEnvironment) metricName(fqName string) string {
+	return env.prefix + fqName + env.suffix
+}
+
+// copy returns an environment querying the same database as env, whose
+// fields can be changed for a single metric.
+func (env *dbEnvironment) copy() *dbEnvironment {
+	return &dbEnvironment{
+		sid:          env.sid,
+		dsn:          env.dsn,
+		conns:        env.conns,
+		dedicated:    env.dedicated,
+		labels:       env.labels,
+		queryTimeout: env.queryTimeout,
+		credentials:  env.credentials,
+		prefix:       env.prefix,
+		suffix:       env.suffix,
+		maintenance:  env.maintenance,
+		identity:     env.identity,
+		preserveCase: env.preserveCase,
+	}
+}
+
+// timeout returns the query timeout of the environment, which defaults to
+// the query.timeout flag.
+func (env *dbEnvironment) timeout() time.Duration {
+	if env.queryTimeout > 0 {
+		return env.queryTimeout
+	}
+	return time.Duration(*queryTimeout) * time.Second
+}
+
+// targetConfig holds the settings of a SID that override the flags.
+type targetConfig struct {
+	QueryTimeout int
+	MetricPrefix string
+	MetricSuffix string
+	Maintenance  []string
+}
+
+// loadTargetConfig reads a TOML file with a table of settings per SID and
+// applies them to the matching environments.
+func loadTargetConfig(dbEnvs []*dbEnvironment, file string) error {
+	var targets map[string]targetConfig
+	if _, err := toml.DecodeFile(file, &targets); err != nil {
+		return err
+	}
+	for _, env := range dbEnvs {
+		target, ok := targets[env.sid]
+		if !ok {
+			continue
+		}
+		if target.QueryTimeout > 0 {
+			env.queryTimeout = time.Duration(target.QueryTimeout) * time.Second
+		}
+		if invalidNameChars.MatchString(target.MetricPrefix+target.MetricSuffix) ||
+			(target.MetricPrefix != "" && target.MetricPrefix[0] >= '0' && target.MetricPrefix[0] <= '9') {
+			return fmt.Errorf("invalid metric prefix: %q or suffix: %q for SID: %s", target.MetricPrefix, target.MetricSuffix, env.sid)
+		}
+		env.prefix, env.suffix = target.MetricPrefix, target.MetricSuffix
+		for _, spec := range target.Maintenance {
+			window, err := parseMaintenanceWindow(spec)
+			if err != nil {
+				return fmt.Errorf("SID: %s has an %s", env.sid, err)
+			}
+			env.maintenance = append(env.maintenance, window)
+		}
+	}
+	return nil
+}
+
+// loadLabelMapping reads a TOML file with a table of labels per SID and
+// attaches them to the matching environments. Every environment gets the same
+// label names so that the metrics of all SIDs stay consistent, labels missing
+// for a SID are left empty.
+func loadLabelMapping(dbEnvs []*dbEnvironment, file string) error {
+	var mapping map[string]map[string]string
+	if _, err := toml.DecodeFile(file, &mapping); err != nil {
+		return err
+	}
+	names := make(map[string]bool)
+	for _, labels := range mapping {
+		for name := range labels {
+			if !model.LabelName(name).IsValid() || strings.HasPrefix(name, "__") {
+				return fmt.Errorf("invalid label name: %s", name)
+			}
+			if name == "sid" || name == "database" {
+				return fmt.Errorf("the label: %s is set by the exporter", name)
+			}
+			names[name] = true
+		}
+	}
+	for _, env := range dbEnvs {
+		env.labels = prometheus.Labels{}
+		for name := range names {
+			env.labels[name] = mapping[env.sid][name]
+		}
+	}
+	return nil
+}
+
+// groupDatabases adds the database label to the metrics of dbEnvs. groups
+// maps logical databases, like a RAC database, to the comma separated SIDs of
+// their instances. A SID outside of the groups is its own database.
+func groupDatabases(dbEnvs []*dbEnvironment, groups map[string]string) error {
+	databases := make(map[string]string)
+	for database, sids := range groups {
+		for _, sid := range strings.Split(sids, ",") {
+			if sid = strings.TrimSpace(sid); sid == "" {
+				continue
+			}
+			if other, ok := databases[sid]; ok && other != database {
+				return fmt.Errorf("SID: %s is in the databases: %s and %s", sid, other, database)
+			}
+			databases[sid] = database
+		}
+	}
+	for _, env := range dbEnvs {
+		if _, ok := env.labels["database"]; ok {
+			return fmt.Errorf("the label mapping of SID: %s already sets the database label", env.sid)
+		}
+		database, ok := databases[env.sid]
+		if !ok {
+			database = env.sid
+		}
+		labels := prometheus.Labels{"database": database}
+		for name, value := range env.labels {
+			labels[name] = value
+		}
+		env.labels = labels
+	}
+	return nil
 }
 
 type credentials struct {
@@ -387,6 +2267,14 @@ type credentials struct {
 }
 
 func getParameter(ssmsvc *ssm.SSM, keyname *string) string {
+	value, err := lookupParameter(ssmsvc, keyname)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	return value
+}
+
+func lookupParameter(ssmsvc *ssm.SSM, keyname *string) (string, error) {
 	key := fmt.Sprintf("/%s/%s", *ssmPrefix, *keyname)
 	withDecryption := true
 	param, err := ssmsvc.GetParameter(&ssm.GetParameterInput{
@@ -394,30 +2282,157 @@ func getParameter(ssmsvc *ssm.SSM, keyname *string) string {
 		WithDecryption: &withDecryption,
 	})
 	if err != nil {
-		log.Fatalf("failed to retrieve aws key: %s with: %s", *keyname, err)
+		return "", fmt.Errorf("failed to retrieve aws key: %s with: %s", *keyname, err)
+	}
+	return *param.Parameter.Value, nil
+}
+
+// secretReader reads the secret named keyname from a secret backend.
+type secretReader func(keyname *string) (string, error)
+
+// secretCredentials returns a function reading the current credentials of sid
+// from a secret backend and building its DSN, so that rotated passwords are
+// picked up.
+func secretCredentials(read secretReader, sid string) func() (string, error) {
+	return func() (string, error) {
+		var values []string
+		for _, keyname := range []*string{ssmUser, ssmPassword, ssmHost, ssmPort} {
+			value, err := read(keyname)
+			if err != nil {
+				return "", err
+			}
+			values = append(values, value)
+		}
+		dsn := fmt.Sprintf(dsnFormat, values[0], values[1], values[2], values[3], sid)
+		if len(*dsnOptions) > 0 {
+			return applyDSNOptions(dsn, *dsnOptions)
+		}
+		return dsn, nil
 	}
-	return *param.Parameter.Value
 }
 
 const dsnFormat = "%s/%s@%s:%s/%s"
 
+// sidFromDSN extracts the oracle SID from a connection string like
+// user/password@host:port/SID?params. The credentials may be left empty
+// (/@host:port/SID) to authenticate with the operating system user.
+func sidFromDSN(dsn string) (string, error) {
+	connect := dsn
+	if i := strings.LastIndex(connect, "@"); i >= 0 {
+		connect = connect[i+1:]
+	}
+	if i := strings.Index(connect, "?"); i >= 0 {
+		connect = connect[:i]
+	}
+	parts := strings.Split(connect, "/")
+	sid := parts[len(parts)-1]
+	if sid == "" {
+		return "", fmt.Errorf("unable to get oracle SID from data source environment: %s", dsn)
+	}
+	return sid, nil
+}
+
+// Connection parameters understood by oci8.
+var oci8DSNOptions = map[string]bool{
+	"as":              true,
+	"isolation":       true,
+	"loc":             true,
+	"prefetch_memory": true,
+	"prefetch_rows":   true,
+	"questionph":      true,
+}
+
+// applyDSNOptions adds options to the query parameters of dsn. Parameters
+// already set in dsn take precedence.
+func applyDSNOptions(dsn string, options map[string]string) (string, error) {
+	base, query := dsn, ""
+	if i := strings.Index(dsn, "?"); i >= 0 {
+		base, query = dsn[:i], dsn[i+1:]
+	}
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return "", err
+	}
+	for key, value := range options {
+		if _, ok := values[key]; !ok {
+			values.Set(key, value)
+		}
+	}
+	for key := range values {
+		if !oci8DSNOptions[key] {
+			return "", fmt.Errorf("unknown oci8 connection parameter: %s", key)
+		}
+	}
+	return base + "?" + values.Encode(), nil
+}
+
+// uniqueSIDs checks that each SID of dbEnvs is configured once, as their
+// metrics would otherwise collide. With the first mode the later data sources
+// of a SID are dropped instead of failing.
+func uniqueSIDs(dbEnvs []*dbEnvironment, mode string) ([]*dbEnvironment, error) {
+	seen := make(map[string]bool)
+	var unique []*dbEnvironment
+	for _, env := range dbEnvs {
+		if !seen[env.sid] {
+			seen[env.sid] = true
+			unique = append(unique, env)
+			continue
+		}
+		if mode != "first" {
+			return nil, fmt.Errorf("SID: %s is configured several times", env.sid)
+		}
+		log.Warnf("SID: %s is configured several times, ignoring its data source: %s", env.sid, redactDSN(env.dsn))
+	}
+	return unique, nil
+}
+
+// filterSIDs returns the environments whose SID is in the comma separated
+// list sids.
+func filterSIDs(dbEnvs []*dbEnvironment, sids string) []*dbEnvironment {
+	wanted := make(map[string]bool)
+	for _, sid := range strings.Split(sids, ",") {
+		if sid = strings.TrimSpace(sid); sid != "" {
+			wanted[sid] = true
+		}
+	}
+	var filtered []*dbEnvironment
+	for _, env := range dbEnvs {
+		if wanted[env.sid] {
+			filtered = append(filtered, env)
+			delete(wanted, env.sid)
+		} else {
+			log.Infof("skipping SID: %s, it isn't in the scraped SIDs", env.sid)
+		}
+	}
+	for sid := range wanted {
+		log.Warnf("SID: %s to scrape is not configured", sid)
+	}
+	return filtered
+}
+
 func generateDSN(s string) ([]*dbEnvironment, error) {
 	var dbEnvs []*dbEnvironment
 	if s != "" {
 		// system/blabla@docker.for.mac.localhost:1521/DINTDB
 		dsnEnvs := strings.Split(s, ",")
 		for _, env := range dsnEnvs {
-			parts := strings.Split(env, "/")
-			if len(parts) < 3 {
-				return nil, fmt.Errorf("unable to get oracle SID from data source environment: %s", env)
+			oracleSID, err := sidFromDSN(env)
+			if err != nil {
+				return nil, err
 			}
-			oracleSID := parts[len(parts)-1]
-			log.Infof("found oracle SID: %s in connection string: %s", oracleSID, env)
+			log.Infof("found oracle SID: %s in connection string: %s", oracleSID, redactDSN(env))
 			dbEnvs = append(dbEnvs, &dbEnvironment{sid: oracleSID, dsn: env})
 		}
 		return dbEnvs, nil
 	}
 
+	if *secretBackend == "conjur" {
+		return generateConjurDSN()
+	}
+	if *ssmPrefix == "" {
+		return nil, errors.New("no data source configured, set either --dsn or --ssm.prefix")
+	}
+
 	sess, err := session.NewSessionWithOptions(session.Options{
 		Config:            aws.Config{Region: aws.String(*awsRegion)},
 		SharedConfigState: session.SharedConfigEnable,
@@ -427,6 +2442,9 @@ func generateDSN(s string) ([]*dbEnvironment, error) {
 	}
 
 	ssmsvc := ssm.New(sess, aws.NewConfig().WithRegion(*awsRegion))
+	read := func(keyname *string) (string, error) {
+		return lookupParameter(ssmsvc, keyname)
+	}
 
 	user := getParameter(ssmsvc, ssmUser)
 	pw := getParameter(ssmsvc, ssmPassword)
@@ -440,42 +2458,255 @@ func generateDSN(s string) ([]*dbEnvironment, error) {
 	}
 	for _, sid := range sidsList {
 		dsn := fmt.Sprintf(dsnFormat, user, pw, host, port, sid)
-		dbEnvs = append(dbEnvs, &dbEnvironment{sid: sid, dsn: dsn})
+		dbEnvs = append(dbEnvs, &dbEnvironment{sid: sid, dsn: dsn, credentials: secretCredentials(read, sid)})
+	}
+	return dbEnvs, nil
+}
+
+// loadEnvironments returns the databases to scrape, as configured by the
+// flags and the target config and label mapping files.
+func loadEnvironments() ([]*dbEnvironment, error) {
+	dbEnvs, err := generateDSN(*dataSourceNames)
+	if err != nil {
+		return nil, err
+	}
+	if dbEnvs, err = uniqueSIDs(dbEnvs, *duplicateSIDs); err != nil {
+		return nil, err
+	}
+	if *scrapeSIDs != "" {
+		if dbEnvs = filterSIDs(dbEnvs, *scrapeSIDs); len(dbEnvs) == 0 {
+			return nil, fmt.Errorf("none of the SIDs: %s is configured", *scrapeSIDs)
+		}
+	}
+	if len(*dsnOptions) > 0 {
+		for _, env := range dbEnvs {
+			if env.dsn, err = applyDSNOptions(env.dsn, *dsnOptions); err != nil {
+				return nil, fmt.Errorf("invalid DSN options for SID: %s with: %s", env.sid, err)
+			}
+		}
+	}
+	if *targetConfigFile != "" {
+		if err := loadTargetConfig(dbEnvs, *targetConfigFile); err != nil {
+			return nil, fmt.Errorf("failed loading target config: %s with: %s", *targetConfigFile, err)
+		}
+	}
+	if *labelMappingFile != "" {
+		if err := loadLabelMapping(dbEnvs, *labelMappingFile); err != nil {
+			return nil, fmt.Errorf("failed loading label mapping: %s with: %s", *labelMappingFile, err)
+		}
+	}
+	if len(*databaseGroups) > 0 {
+		if err := groupDatabases(dbEnvs, *databaseGroups); err != nil {
+			return nil, fmt.Errorf("invalid database groups: %s", err)
+		}
+	}
+	if *disableSIDLabel {
+		if err := checkDistinctTargets(dbEnvs); err != nil {
+			return nil, err
+		}
 	}
 	return dbEnvs, nil
 }
 
+// checkDistinctTargets returns an error if two databases of dbEnvs would
+// export the same series without the sid label, as neither their labels nor
+// their metric name affixes tell them apart.
+func checkDistinctTargets(dbEnvs []*dbEnvironment) error {
+	seen := make(map[string]string)
+	for _, env := range dbEnvs {
+		key := fmt.Sprint(env.prefix, "|", env.suffix, "|", env.labels)
+		if sid, ok := seen[key]; ok {
+			return fmt.Errorf("SIDs: %s and %s can't be told apart without the sid label, give them different labels with -label.mapping-file or -label.database", sid, env.sid)
+		}
+		seen[key] = env.sid
+	}
+	return nil
+}
+
+// checkLabelCollisions returns an error if a label of the databases, set by
+// the label mapping or the database groups, is also a label of one of the
+// metrics, which could then not be exported.
+func checkLabelCollisions(dbEnvs []*dbEnvironment, metrics []*Metric) error {
+	names := make(map[string]bool)
+	for _, env := range dbEnvs {
+		for name := range env.labels {
+			names[name] = true
+		}
+	}
+	for _, metric := range metrics {
+		defs := []*Metric{metric}
+		for _, set := range metric.ResultSets {
+			defs = append(defs, set)
+		}
+		for _, def := range defs {
+			for _, label := range def.Labels {
+				if names[label] {
+					return fmt.Errorf("the label: %s of metric: %s is also set by the label mapping", label, def.Context)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// loadScrapedMetrics returns the metrics to scrape, there are none in
+// availability mode. The default metrics file is only read again when
+// readDefaults is set.
+func loadScrapedMetrics(readDefaults bool) ([]*Metric, error) {
+	if *mode == "availability" {
+		return nil, nil
+	}
+	return loadMetrics(readDefaults)
+}
+
 func main() {
 	app.Version(Version)
 	log.AddFlags(app)
 	kingpin.MustParse(app.Parse(os.Args[1:]))
 
 	log.Infoln("starting oracledb_exporter " + Version)
-	dbEnvs, err := generateDSN(*dataSourceNames)
+	startTime.SetToCurrentTime()
+	if err := checkSessionSettings(); err != nil {
+		log.Fatalln(err)
+	}
+	if _, err := maxprocs.Set(maxprocs.Logger(log.Infof)); err != nil {
+		log.Warnf("failed to set GOMAXPROCS from the CPU quota: %s", err)
+	}
+	dbEnvs, err := loadEnvironments()
 	if err != nil {
 		log.Fatalln(err)
 	}
+	if *testConnection {
+		if !testConnections(dbEnvs) {
+			os.Exit(1)
+		}
+		return
+	}
 
-	// Load default metrics
-	var metrics struct{ Metric []*Metric }
-	if _, err := toml.DecodeFile(*defaultFileMetrics, &metrics); err != nil {
-		log.Fatalf("failed loading default metrics: %s with: %s", *defaultFileMetrics, err)
+	if *mode == "availability" {
+		log.Infoln("availability mode, only the database availability is checked")
+	}
+	metrics, err := loadScrapedMetrics(true)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if err := checkLabelCollisions(dbEnvs, metrics); err != nil {
+		log.Fatalln(err)
+	}
+	setConfigMetrics(metrics)
+	openDatabases(dbEnvs)
+	if *warmupConcurrency > 0 {
+		warmup(dbEnvs, *warmupConcurrency, time.Duration(*warmupTimeout)*time.Second)
+	}
+	if *pushGatewayURL != "" || *textfileOutput != "" {
+		exportOnce(NewExporter(dbEnvs, metrics))
+		return
 	}
 
-	// If custom metrics, load it
-	var addMetrics struct{ Metric []*Metric }
-	if strings.Compare(*customMetrics, "") != 0 {
-		if _, err := toml.DecodeFile(*customMetrics, &addMetrics); err != nil {
-			log.Fatalf("failed loading custom metrics: %s with: %s", *customMetrics, err)
+	paths, err := metricsByPath(metrics, *metricPath, *extraMetricPaths)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	exporter := NewExporter(dbEnvs, paths[*metricPath])
+	handleMetrics(*metricPath, exporter, promhttp.InstrumentMetricHandler(
+		prometheus.DefaultRegisterer, metricsHandler(exporter, prometheus.DefaultGatherer),
+	))
+	exporters := map[string]*Exporter{*metricPath: exporter}
+	for path, pathMetrics := range paths {
+		if path == *metricPath {
+			continue
 		}
-		metrics.Metric = append(metrics.Metric, addMetrics.Metric...)
+		log.Infof("serving %d metrics on: %s", len(pathMetrics), path)
+		pathExporter := NewExporter(dbEnvs, pathMetrics)
+		exporters[path] = pathExporter
+		handleMetrics(path, pathExporter, metricsHandler(pathExporter))
 	}
-	exporter := NewExporter(dbEnvs, metrics.Metric)
-	prometheus.MustRegister(exporter)
-	http.Handle(*metricPath, promhttp.Handler())
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Write(landingPage)
 	})
-	log.Infoln("listening on", *listenAddress)
-	log.Fatal(http.ListenAndServe(*listenAddress, nil))
+	if *configEndpoint {
+		http.HandleFunc("/config", configHandler(exporters))
+	}
+	go reloadOnSignal(dbEnvs, exporters)
+	log.Infoln("listening on", *listenAddress, "network", *webNetwork)
+	listener, err := net.Listen(*webNetwork, *listenAddress)
+	if err != nil {
+		log.Fatalf("failed to listen on: %s with: %s", *listenAddress, err)
+	}
+	if *maxConnections > 0 {
+		listener = newLimitListener(listener, *maxConnections)
+	}
+	server := &http.Server{Addr: *listenAddress, MaxHeaderBytes: *maxHeaderBytes}
+	logger := kitlog.NewLogfmtLogger(kitlog.NewSyncWriter(os.Stderr))
+	log.Fatal(web.Serve(listener, server, *webConfig, logger))
+}
+
+// onceCollector collects exporter without describing it. Registering the
+// Exporter itself would scrape the databases twice, its Describe collects the
+// metrics to describe them.
+type onceCollector struct {
+	exporter *Exporter
+}
+
+// Describe implements prometheus.Collector, the collector is unchecked.
+func (c onceCollector) Describe(ch chan<- *prometheus.Desc) {}
+
+// Collect implements prometheus.Collector.
+func (c onceCollector) Collect(ch chan<- prometheus.Metric) {
+	c.exporter.Collect(ch)
+}
+
+// exportOnce scrapes exporter once and pushes the metrics to the Pushgateway
+// or writes them to the textfile.
+func exportOnce(exporter *Exporter) {
+	if *pushGatewayURL != "" {
+		log.Infoln("pushing metrics to", *pushGatewayURL)
+		if err := push.New(*pushGatewayURL, *pushJob).Collector(onceCollector{exporter}).Push(); err != nil {
+			log.Fatalf("failed to push metrics to: %s with: %s", *pushGatewayURL, err)
+		}
+		return
+	}
+	if *textfileOutput != "" {
+		log.Infoln("writing metrics to", *textfileOutput)
+		if err := writeTextfile(exporter, *textfileOutput); err != nil {
+			log.Fatalf("failed to write metrics to: %s with: %s", *textfileOutput, err)
+		}
+	}
+}
+
+// handleMetrics serves the metrics of exporter gathered by handler on path.
+func handleMetrics(path string, exporter *Exporter, handler http.Handler) {
+	if *strictMode {
+		handler = strictHandler(exporter, handler)
+	}
+	http.Handle(path, handler)
+}
+
+// metricsByPath splits metrics by the path serving them. extraPaths maps
+// additional paths to comma separated lists of metric contexts, the other
+// metrics are served on defaultPath.
+func metricsByPath(metrics []*Metric, defaultPath string, extraPaths map[string]string) (map[string][]*Metric, error) {
+	pathOf := make(map[string]string)
+	for path, contexts := range extraPaths {
+		if path == defaultPath {
+			return nil, fmt.Errorf("extra metrics path: %s is the telemetry path", path)
+		}
+		for _, c := range strings.Split(contexts, ",") {
+			if c = strings.TrimSpace(c); c != "" {
+				pathOf[c] = path
+			}
+		}
+	}
+	paths := map[string][]*Metric{defaultPath: nil}
+	for path := range extraPaths {
+		paths[path] = nil
+	}
+	for _, metric := range metrics {
+		path, ok := pathOf[metric.Context]
+		if !ok {
+			path = defaultPath
+		}
+		paths[path] = append(paths[path], metric)
+	}
+	return paths, nil
 }
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// maintenanceWindow is a daily time range, in minutes since midnight, during
+// which a database isn't scraped. A range whose end is before its start spans
+// midnight. days are the days the window starts on, nil for every day.
+type maintenanceWindow struct {
+	days       map[time.Weekday]bool
+	start, end int
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// maintenanceSpec matches a window like "Mon-Fri 01:00-03:00", "Sat,Sun
+// 00:00-06:00" or "22:00-02:00".
+var maintenanceSpec = regexp.MustCompile(`^(?:([A-Za-z,-]+)\s+)?(\d{1,2}):(\d{2})-(\d{1,2}):(\d{2})$`)
+
+// parseMaintenanceWindow parses a window of the maintenance target setting.
+func parseMaintenanceWindow(spec string) (maintenanceWindow, error) {
+	var w maintenanceWindow
+	m := maintenanceSpec.FindStringSubmatch(strings.TrimSpace(spec))
+	if m == nil {
+		return w, fmt.Errorf("invalid maintenance window: %s, expected like Mon-Fri 01:00-03:00", spec)
+	}
+	if m[1] != "" {
+		days, err := parseWeekdays(m[1])
+		if err != nil {
+			return w, fmt.Errorf("invalid maintenance window: %s with: %s", spec, err)
+		}
+		w.days = days
+	}
+	var err error
+	if w.start, err = minutes(m[2], m[3]); err != nil {
+		return w, fmt.Errorf("invalid maintenance window: %s with: %s", spec, err)
+	}
+	if w.end, err = minutes(m[4], m[5]); err != nil {
+		return w, fmt.Errorf("invalid maintenance window: %s with: %s", spec, err)
+	}
+	return w, nil
+}
+
+// parseWeekdays parses a comma separated list of days or day ranges, like
+// Mon-Fri,Sun.
+func parseWeekdays(s string) (map[time.Weekday]bool, error) {
+	days := make(map[time.Weekday]bool)
+	for _, item := range strings.Split(strings.ToLower(s), ",") {
+		bounds := strings.SplitN(item, "-", 2)
+		first, ok := weekdays[bounds[0]]
+		if !ok {
+			return nil, fmt.Errorf("unknown day: %s", bounds[0])
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, ok = weekdays[bounds[1]]; !ok {
+				return nil, fmt.Errorf("unknown day: %s", bounds[1])
+			}
+		}
+		for day := first; ; day = (day + 1) % 7 {
+			days[day] = true
+			if day == last {
+				break
+			}
+		}
+	}
+	return days, nil
+}
+
+func minutes(hours string, mins string) (int, error) {
+	var h, m int
+	fmt.Sscan(hours, &h)
+	fmt.Sscan(mins, &m)
+	if h > 23 || m > 59 {
+		return 0, fmt.Errorf("invalid time: %s:%s", hours, mins)
+	}
+	return h*60 + m, nil
+}
+
+// contains reports whether t is in the window.
+func (w maintenanceWindow) contains(t time.Time) bool {
+	now := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+	switch {
+	case w.start <= w.end:
+		if now < w.start || now >= w.end {
+			return false
+		}
+	case now >= w.start:
+	case now < w.end:
+		// After midnight, the window started the day before.
+		day = (day + 6) % 7
+	default:
+		return false
+	}
+	return w.days == nil || w.days[day]
+}
+
+// inMaintenance reports whether env is in one of its maintenance windows at t.
+func (env *dbEnvironment) inMaintenance(t time.Time) bool {
+	for _, w := range env.maintenance {
+		if w.contains(t) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// rateSample is the last value seen of a series whose rate is exported.
+type rateSample struct {
+	value     float64
+	timestamp time.Time
+}
+
+// rateTracker turns the values of counters into per-second rates between two
+// scrapes.
+type rateTracker struct {
+	mtx     sync.Mutex
+	samples map[string]rateSample
+}
+
+var rates = &rateTracker{samples: make(map[string]rateSample)}
+
+// rate records value for the series key and returns its per-second rate since
+// the previous value. A decrease, as after a database restart, gives 0. It
+// returns false on the first value of a series.
+func (t *rateTracker) rate(key string, value float64, now time.Time) (float64, bool) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	previous, ok := t.samples[key]
+	t.samples[key] = rateSample{value: value, timestamp: now}
+	if !ok {
+		return 0, false
+	}
+	elapsed := now.Sub(previous.timestamp).Seconds()
+	if elapsed <= 0 || value < previous.value {
+		return 0, true
+	}
+	return (value - previous.value) / elapsed, true
+}
+
+// rateMetric is a gauge holding the rate of a scraped metric, with the same
+// descriptor and labels.
+type rateMetric struct {
+	desc   *prometheus.Desc
+	metric *dto.Metric
+}
+
+func (m *rateMetric) Desc() *prometheus.Desc {
+	return m.desc
+}
+
+func (m *rateMetric) Write(out *dto.Metric) error {
+	*out = *m.metric
+	return nil
+}
+
+// sendRates reads the metrics scraped for env from in and sends their rates
+// to out. Metrics seen for the first time are only recorded.
+func sendRates(env *dbEnvironment, in <-chan prometheus.Metric, out chan<- prometheus.Metric) {
+	now := time.Now()
+	for m := range in {
+		var metric dto.Metric
+		if err := m.Write(&metric); err != nil {
+			continue
+		}
+		var value float64
+		switch {
+		case metric.Counter != nil:
+			value = metric.Counter.GetValue()
+		case metric.Gauge != nil:
+			value = metric.Gauge.GetValue()
+		case metric.Untyped != nil:
+			value = metric.Untyped.GetValue()
+		default:
+			continue
+		}
+
+		key := []string{env.sid, m.Desc().String()}
+		for _, label := range metric.Label {
+			key = append(key, label.GetName()+"="+label.GetValue())
+		}
+		rate, ok := rates.rate(strings.Join(key, ","), value, now)
+		if !ok {
+			continue
+		}
+		metric.Counter, metric.Untyped = nil, nil
+		metric.Gauge = &dto.Gauge{Value: &rate}
+		out <- &rateMetric{desc: m.Desc(), metric: &metric}
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+
+	"github.com/prometheus/common/log"
+)
+
+// reloadOnSignal reloads the databases and metrics of exporters on SIGHUP.
+// dbEnvs are the databases currently scraped by exporters.
+func reloadOnSignal(dbEnvs []*dbEnvironment, exporters map[string]*Exporter) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		log.Infoln("reloading the configuration")
+		reloaded, err := reload(dbEnvs, exporters)
+		if err != nil {
+			log.Errorf("failed to reload the configuration with: %s", err)
+			continue
+		}
+		dbEnvs = reloaded
+	}
+}
+
+// reload loads the configuration again and applies it to exporters. The
+// databases that are unchanged keep their connections, the added ones are
+// opened and the removed ones are closed once the exporters no longer scrape
+// them. It returns the databases now scraped.
+func reload(current []*dbEnvironment, exporters map[string]*Exporter) ([]*dbEnvironment, error) {
+	fresh, err := loadEnvironments()
+	if err != nil {
+		return nil, err
+	}
+	metrics, err := loadScrapedMetrics(*reloadDefaults)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkLabelCollisions(fresh, metrics); err != nil {
+		return nil, err
+	}
+	paths, err := metricsByPath(metrics, *metricPath, *extraMetricPaths)
+	if err != nil {
+		return nil, err
+	}
+	// The definitions are hashed before the exporters complete them.
+	setConfigMetrics(metrics)
+
+	dbEnvs, added, removed := mergeEnvironments(current, fresh)
+	openDatabases(added)
+	// A reload is the way to retry a login without waiting for the backoff.
+	for _, env := range dbEnvs {
+		env.clearAuthBackoff()
+	}
+	for path, e := range exporters {
+		e.Reload(dbEnvs, paths[path])
+	}
+	// Metrics may change their labels with the new configuration.
+	descs.reset()
+	// Reload returns once the scrapes of the removed databases completed.
+	closeDatabases(removed)
+	log.Infof("reloaded the configuration, %d SIDs added and %d removed", len(added), len(removed))
+	return dbEnvs, nil
+}
+
+// mergeEnvironments returns the databases of fresh, where those configured
+// like in current are taken from current to keep their connections, along
+// with the databases of fresh to open and those of current to close.
+func mergeEnvironments(current, fresh []*dbEnvironment) (dbEnvs, added, removed []*dbEnvironment) {
+	bySID := make(map[string]*dbEnvironment)
+	for _, env := range current {
+		bySID[env.sid] = env
+	}
+	for _, env := range fresh {
+		if old, ok := bySID[env.sid]; ok && sameEnvironment(old, env) {
+			delete(bySID, env.sid)
+			dbEnvs = append(dbEnvs, old)
+			continue
+		}
+		dbEnvs = append(dbEnvs, env)
+		added = append(added, env)
+	}
+	for _, env := range current {
+		if _, ok := bySID[env.sid]; ok {
+			removed = append(removed, env)
+		}
+	}
+	return dbEnvs, added, removed
+}
+
+func sameEnvironment(a, b *dbEnvironment) bool {
+	return a.currentDSN() == b.currentDSN() && a.queryTimeout == b.queryTimeout && reflect.DeepEqual(a.labels, b.labels) &&
+		a.prefix == b.prefix && a.suffix == b.suffix && reflect.DeepEqual(a.maintenance, b.maintenance)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// readMetricsFile returns the content of a metrics file, which is either a
+// local path, an http(s):// URL or an s3://bucket/key URL.
+func readMetricsFile(file string) ([]byte, error) {
+	switch {
+	case strings.HasPrefix(file, "http://"), strings.HasPrefix(file, "https://"):
+		return fetchHTTP(file)
+	case strings.HasPrefix(file, "s3://"):
+		return fetchS3(file)
+	}
+	return ioutil.ReadFile(file)
+}
+
+func fetchTimeout() time.Duration {
+	return time.Duration(*customFetchTimeout) * time.Second
+}
+
+func fetchHTTP(file string) ([]byte, error) {
+	client := &http.Client{Timeout: fetchTimeout()}
+	resp, err := client.Get(file)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+func fetchS3(file string) ([]byte, error) {
+	u, err := url.Parse(file)
+	if err != nil {
+		return nil, err
+	}
+	key := strings.TrimPrefix(u.Path, "/")
+	if u.Host == "" || key == "" {
+		return nil, fmt.Errorf("invalid S3 URL, expected s3://bucket/key")
+	}
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            aws.Config{Region: aws.String(*awsRegion)},
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), fetchTimeout())
+	defer cancel()
+	out, err := s3.New(sess).GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(u.Host),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer out.Body.Close()
+	return ioutil.ReadAll(out.Body)
+}
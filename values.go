@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// knownValueTypes are the types a value column can be declared with in
+// valuetypes, each parsed by a single parser instead of guessing.
+var knownValueTypes = map[string]bool{
+	"float":    true,
+	"int":      true,
+	"date":     true,
+	"bool":     true,
+	"bytes":    true,
+	"interval": true,
+}
+
+// parseValue parses raw as a value of valueType. Numbers are multiplied by
+// scale, the factor converting the time unit of the metric to seconds. An
+// empty valueType tries a number then a date.
+func parseValue(raw string, valueType string, separators string, scale float64) (float64, error) {
+	raw = strings.TrimSpace(raw)
+	switch valueType {
+	case "":
+		if value, err := parseNumber(raw, separators); err == nil {
+			return value * scale, nil
+		}
+		if t, err := parseTimestamp(raw); err == nil {
+			return float64(t.Unix()), nil
+		}
+		return 0, errors.New("neither a number nor a date")
+	case "float":
+		value, err := parseNumber(raw, separators)
+		if err != nil {
+			return 0, errors.New("not a number")
+		}
+		return value * scale, nil
+	case "int":
+		value, err := strconv.ParseInt(stripSeparators(raw, separators), 10, 64)
+		if err != nil {
+			return 0, errors.New("not an integer")
+		}
+		return float64(value) * scale, nil
+	case "date":
+		t, err := parseTimestamp(raw)
+		if err != nil {
+			return 0, errors.New("not a date")
+		}
+		return float64(t.Unix()), nil
+	case "bool":
+		return parseBool(raw)
+	case "bytes":
+		return parseBytes(raw)
+	case "interval":
+		return parseInterval(raw)
+	}
+	return 0, fmt.Errorf("unknown value type: %s", valueType)
+}
+
+func parseBool(raw string) (float64, error) {
+	switch strings.ToUpper(raw) {
+	case "1", "TRUE", "Y", "YES":
+		return 1, nil
+	case "0", "FALSE", "N", "NO":
+		return 0, nil
+	}
+	return 0, errors.New("not a boolean")
+}
+
+// byteSize matches a size with an optional binary unit, like the values of
+// the size parameters: 2G, 512M or 1048576.
+var byteSize = regexp.MustCompile(`^(?i)(\d+(?:\.\d+)?)\s*([KMGTP]?)B?$`)
+
+func parseBytes(raw string) (float64, error) {
+	m := byteSize.FindStringSubmatch(raw)
+	if m == nil {
+		return 0, errors.New("not a size in bytes")
+	}
+	value, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return 0, err
+	}
+	exponent := strings.Index("KMGTP", strings.ToUpper(m[2])) + 1
+	if m[2] == "" {
+		exponent = 0
+	}
+	return value * math.Pow(1024, float64(exponent)), nil
+}
+
+// dayToSecond matches an INTERVAL DAY TO SECOND value, like +01 02:03:04.5.
+var dayToSecond = regexp.MustCompile(`^([+-])?(\d+) (\d+):(\d+):(\d+(?:\.\d+)?)$`)
+
+// parseInterval returns the seconds of an INTERVAL DAY TO SECOND value, in
+// the Oracle format or as a Go duration, the type oci8 returns it as.
+func parseInterval(raw string) (float64, error) {
+	if d, err := time.ParseDuration(raw); err == nil {
+		return d.Seconds(), nil
+	}
+	m := dayToSecond.FindStringSubmatch(raw)
+	if m == nil {
+		return 0, errors.New("not an interval")
+	}
+	var seconds float64
+	for i, factor := range []float64{86400, 3600, 60, 1} {
+		part, err := strconv.ParseFloat(m[i+2], 64)
+		if err != nil {
+			return 0, err
+		}
+		seconds += part * factor
+	}
+	if m[1] == "-" {
+		seconds = -seconds
+	}
+	return seconds, nil
+}